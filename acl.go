@@ -0,0 +1,167 @@
+package pipe
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrAccessDenied = errors.New("access denied")
+
+// ACL allows or denies peers by source IP. Deny rules win, and if there are
+// allow rules an address must match one of them. Rules are CIDRs or single
+// addresses.
+//
+// The file format read by LoadACL has one rule per line, "allow <cidr>" or
+// "deny <cidr>", blank lines and lines starting with '#' are ignored.
+type ACL struct {
+	mux   sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	file  string
+}
+
+func NewACL(allow, deny []string) (*ACL, error) {
+	acl := &ACL{}
+	err := acl.Set(allow, deny)
+	if err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func LoadACL(file string) (*ACL, error) {
+	acl := &ACL{file: file}
+	err := acl.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Set replaces all rules, the old ones stay if any rule is invalid.
+func (acl *ACL) Set(allow, deny []string) error {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+	acl.mux.Lock()
+	acl.allow, acl.deny = allowNets, denyNets
+	acl.mux.Unlock()
+	return nil
+}
+
+// Reload reads the rules again from the file the ACL was loaded from, the
+// old ones stay if the file can't be read or parsed.
+func (acl *ACL) Reload() error {
+	if acl.file == "" {
+		return errors.New("acl: not loaded from a file")
+	}
+	f, err := os.Open(acl.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var allow, deny []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("acl: %v:%v: invalid rule %q", acl.file, n, line)
+		}
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, fields[1])
+		case "deny":
+			deny = append(deny, fields[1])
+		default:
+			return fmt.Errorf("acl: %v:%v: invalid action %q", acl.file, n, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return acl.Set(allow, deny)
+}
+
+func (acl *ACL) Allowed(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+	acl.mux.RLock()
+	defer acl.mux.RUnlock()
+	for _, n := range acl.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(acl.allow) == 0 {
+		return true
+	}
+	for _, n := range acl.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedAddr checks the IP of a net.Addr such as a conn's RemoteAddr,
+// addresses without an IP are only allowed when there are no allow rules.
+func (acl *ACL) AllowedAddr(addr net.Addr) bool {
+	if acl == nil {
+		return true
+	}
+	var ip net.IP
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		ip = v.IP
+	case *net.UDPAddr:
+		ip = v.IP
+	default:
+		ip = net.ParseIP(hostOf(addr))
+	}
+	if ip == nil {
+		acl.mux.RLock()
+		defer acl.mux.RUnlock()
+		return len(acl.allow) == 0
+	}
+	return acl.Allowed(ip)
+}
+
+func parseCIDRs(rules []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(rules))
+	for _, rule := range rules {
+		if !strings.Contains(rule, "/") {
+			ip := net.ParseIP(rule)
+			if ip == nil {
+				return nil, fmt.Errorf("acl: invalid address %q", rule)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(rule)
+		if err != nil {
+			return nil, fmt.Errorf("acl: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
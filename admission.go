@@ -0,0 +1,42 @@
+package pipe
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrTooManySessions      = errors.New("too many sessions")
+	ErrTooManySessionsPerIP = errors.New("too many sessions from this address")
+)
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// isTemporary reports whether an Accept error is worth retrying, such as
+// running out of file descriptors, rather than a closed or broken listener.
+func isTemporary(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	var te interface{ Temporary() bool }
+	if errors.As(err, &te) && te.Temporary() {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	if d == 0 {
+		return minAcceptBackoff
+	}
+	d *= 2
+	if d > maxAcceptBackoff {
+		d = maxAcceptBackoff
+	}
+	return d
+}
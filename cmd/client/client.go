@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"log"
 	"os"
 	"os/signal"
 
@@ -12,23 +14,32 @@ import (
 )
 
 func main() {
-	key, iv := config.KeyIV()
-	packer := &packer.AESCBC{
-		Key: key,
-		IV:  iv,
+	key, err := config.Key()
+	if err != nil {
+		log.Fatalf("Key failed: %v", err)
 	}
+	packer := &packer.AESGCM{Key: key}
 	cliSrc, cliDst := config.ClientAddrs()
 	gorilla.DefaultDialer.HandshakeTimeout = config.Timeout()
 	pClient := &pipe.Pipe{
 		Listen:  protocol.ListenTCP(cliSrc),
-		Dial:    protocol.DialWebsocket(cliDst),
+		Dial:    protocol.WithRetry(protocol.DialWebsocket(cliDst), nil),
 		Packer:  packer,
 		Timeout: config.Timeout(),
 	}
-	pClient.StartClient()
-	defer pClient.Stop()
+	err = pClient.StartClient()
+	if err != nil {
+		log.Fatalf("StartClient failed: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = pClient.Serve(ctx)
+	if err != nil && err != context.Canceled {
+		log.Printf("Serve stopped: %v", err)
+	}
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	<-interrupt
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout())
+	defer cancel()
+	pClient.Shutdown(ctx)
 }
@@ -1,8 +1,13 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
 )
 
 var cliSrc = flag.String("clisrc", ":18080", `src addr`)
@@ -10,21 +15,44 @@ var cliDst = flag.String("clidst", "localhost:18081", `src addr`)
 var svrSrc = flag.String("svrsrc", ":18081", `src addr`)
 var svrDst = flag.String("svrdst", "localhost:18082", `src addr`)
 var timeout = flag.Int("t", 120, `read timeout`)
+var shutdownTimeout = flag.Int("grace", 10, `graceful shutdown timeout`)
 var passwd = flag.String("p", "7yuhdjamfklsdfk$%^&*;d/,.cx,vzbn18276312ojskdlfjal;djfka;", `password`)
+var salt = flag.String("salt", "", `kdf salt, required, a random value of at least 16 characters unique to this deployment and the same on client and server`)
+var kdf = flag.String("kdf", "scrypt", `key derivation function: scrypt or argon2id`)
+var scryptN = flag.Int("scrypt-n", 1<<15, `scrypt cost parameter N`)
+var scryptR = flag.Int("scrypt-r", 8, `scrypt block size parameter r`)
+var scryptP = flag.Int("scrypt-p", 1, `scrypt parallelization parameter p`)
+var argonTime = flag.Uint("argon-time", 1, `argon2id number of passes`)
+var argonMemory = flag.Uint("argon-memory", 64*1024, `argon2id memory in KiB`)
+var argonThreads = flag.Uint("argon-threads", 4, `argon2id parallelism`)
+var aclFile = flag.String("acl", "", `file of "allow <cidr>" and "deny <cidr>" lines, reloaded on SIGHUP`)
 
 func init() {
 	flag.Parse()
 }
 
-func KeyIV() (key, iv []byte) {
-	pass := *passwd
-	for len(pass) < 32 {
-		pass += pass
-	}
+const minSaltLen = 16
 
-	key = []byte(pass)[:32]
-	iv = key[8:24]
-	return key, iv
+// Key derives the 32-byte AES-256-GCM key from the password and salt.
+func Key() ([]byte, error) {
+	return DeriveKey(32)
+}
+
+func DeriveKey(keyLen int) ([]byte, error) {
+	if len(*salt) < minSaltLen {
+		return nil, errors.New("-salt is required: use a random value of at least 16 characters, e.g. from `openssl rand -hex 16`, shared by client and server")
+	}
+	switch *kdf {
+	case "scrypt":
+		return scrypt.Key([]byte(*passwd), []byte(*salt), *scryptN, *scryptR, *scryptP, keyLen)
+	case "argon2id":
+		if *argonTime == 0 || *argonThreads == 0 || *argonThreads > 255 {
+			return nil, fmt.Errorf("invalid argon2id parameters: time %v, threads %v", *argonTime, *argonThreads)
+		}
+		return argon2.IDKey([]byte(*passwd), []byte(*salt), uint32(*argonTime), uint32(*argonMemory), uint8(*argonThreads), uint32(keyLen)), nil
+	default:
+		return nil, fmt.Errorf("invalid kdf: %v", *kdf)
+	}
 }
 
 func ClientAddrs() (string, string) {
@@ -38,3 +66,11 @@ func ServerAddrs() (string, string) {
 func Timeout() time.Duration {
 	return time.Second * time.Duration(*timeout)
 }
+
+func ACLFile() string {
+	return *aclFile
+}
+
+func ShutdownTimeout() time.Duration {
+	return time.Second * time.Duration(*shutdownTimeout)
+}
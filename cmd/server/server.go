@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/lesismal/pipe"
 	"github.com/lesismal/pipe/cmd/config"
@@ -11,11 +14,11 @@ import (
 )
 
 func main() {
-	key, iv := config.KeyIV()
-	packer := &packer.AESCBC{
-		Key: key,
-		IV:  iv,
+	key, err := config.Key()
+	if err != nil {
+		log.Fatalf("Key failed: %v", err)
 	}
+	packer := &packer.AESGCM{Key: key}
 
 	svrSrc, svrDst := config.ServerAddrs()
 	pServer := &pipe.Pipe{
@@ -24,10 +27,39 @@ func main() {
 		Packer:  packer,
 		Timeout: config.Timeout(),
 	}
-	pServer.StartServer()
-	defer pServer.Stop()
+	if file := config.ACLFile(); file != "" {
+		pServer.ACL, err = pipe.LoadACL(file)
+		if err != nil {
+			log.Fatalf("LoadACL failed: %v", err)
+		}
+		go reloadACL(pServer.ACL)
+	}
+	err = pServer.StartServer()
+	if err != nil {
+		log.Fatalf("StartServer failed: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = pServer.Serve(ctx)
+	if err != nil && err != context.Canceled {
+		log.Printf("Serve stopped: %v", err)
+	}
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	<-interrupt
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout())
+	defer cancel()
+	pServer.Shutdown(ctx)
+}
+
+func reloadACL(acl *pipe.ACL) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		err := acl.Reload()
+		if err != nil {
+			log.Printf("ACL reload failed: %v", err)
+			continue
+		}
+		log.Printf("ACL reloaded")
+	}
 }
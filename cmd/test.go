@@ -18,13 +18,8 @@ func main() {
 	websocket.DefaultDialer.HandshakeTimeout = config.Timeout()
 
 	key := make([]byte, 32)
-	iv := make([]byte, 16)
 	rand.Read(key)
-	rand.Read(iv)
-	packer := &packer.AESCBC{
-		Key: key,
-		IV:  iv,
-	}
+	packer := &packer.AESGCM{Key: key}
 
 	cliSrc, cliDst := config.ClientAddrs()
 	svrSrc, svrDst := config.ServerAddrs()
@@ -32,9 +27,10 @@ func main() {
 	pClient := &pipe.Pipe{
 		Listen: protocol.ListenUDP(cliSrc),
 		// Dial:    protocol.DialWebsocket(cliDst),
-		Dial:    protocol.WithWritingDstAddr(cliDst, svrDst, protocol.DialWebsocket),
-		Packer:  packer,
-		Timeout: config.Timeout(),
+		Dial:     protocol.WithWritingDstAddr(cliDst, svrDst, protocol.DialWebsocket),
+		Packer:   packer,
+		Timeout:  config.Timeout(),
+		Datagram: true,
 	}
 	pClient.StartClient()
 	defer pClient.Stop()
@@ -42,9 +38,10 @@ func main() {
 	pServer := &pipe.Pipe{
 		Listen: protocol.ListenWebsocket(svrSrc),
 		// Dial:    protocol.DialUDP(svrDst),
-		Dial:    protocol.WithReadingDstAddr(protocol.DialUDP),
-		Packer:  packer,
-		Timeout: config.Timeout(),
+		Dial:     protocol.WithReadingDstAddr(protocol.DialUDP),
+		Packer:   packer,
+		Timeout:  config.Timeout(),
+		Datagram: true,
 	}
 	pServer.StartServer()
 	defer pServer.Stop()
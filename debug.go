@@ -1,16 +1,29 @@
 package pipe
 
 import (
-	"log"
+	"log/slog"
 	"runtime"
-	"unsafe"
 )
 
+// Recover logs a panic of the calling goroutine to slog.Default(), like a
+// Pipe without a Logger.
 func Recover() {
 	if err := recover(); err != nil {
-		const size = 64 << 10
-		buf := make([]byte, size)
-		buf = buf[:runtime.Stack(buf, false)]
-		log.Printf("execute failed: %v\n%v\n", err, *(*string)(unsafe.Pointer(&buf)))
+		logPanic(slog.Default(), err)
 	}
 }
+
+// RecoverTo logs a panic of the calling goroutine to l, it must be deferred
+// directly: defer pipe.RecoverTo(logger).
+func RecoverTo(l Logger) {
+	if err := recover(); err != nil {
+		logPanic(l, err)
+	}
+}
+
+func logPanic(l Logger, err any) {
+	const size = 64 << 10
+	buf := make([]byte, size)
+	buf = buf[:runtime.Stack(buf, false)]
+	l.Error("execute failed", "err", err, "stack", string(buf))
+}
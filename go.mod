@@ -5,6 +5,10 @@ go 1.21.1
 require (
 	github.com/gorilla/websocket v1.5.1
 	github.com/lesismal/arpc v1.2.14
+	golang.org/x/crypto v0.14.0
 )
 
-require golang.org/x/net v0.17.0 // indirect
+require (
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
@@ -0,0 +1,57 @@
+package pipe
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Logger receives Pipe's log records as a message and key-value pairs, a
+// *slog.Logger satisfies it. Pipe uses slog.Default() if Logger is nil,
+// which writes through the standard log package.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Session describes one accepted connection and its dialed peer. Dst is nil
+// until the dial succeeds.
+type Session struct {
+	ID    uint64
+	Src   net.Conn
+	Dst   net.Conn
+	Start time.Time
+}
+
+// SessionStats is passed to OnSessionClose. SrcToDst and DstToSrc are the
+// bytes read from src and dst, Err is the error that ended the session,
+// io.EOF if the peer closed normally, ErrSessionClosed if it was closed
+// through CloseSession or CloseSessionsFrom.
+type SessionStats struct {
+	Session
+	SrcToDst int64
+	DstToSrc int64
+	Duration time.Duration
+	Err      error
+}
+
+// Hooks are called synchronously and must not block for long: OnAccept and
+// OnReject run on the accept loop and hold up the next Accept, the others run
+// on the session's goroutine.
+type Hooks struct {
+	OnAccept       func(src net.Conn)
+	OnReject       func(src net.Conn, err error)
+	OnDialStart    func(src net.Conn)
+	OnDialError    func(src net.Conn, err error)
+	OnSessionOpen  func(s *Session)
+	OnSessionClose func(s *SessionStats)
+}
+
+func (p *Pipe) logger() Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return slog.Default()
+}
@@ -2,17 +2,70 @@ package pipe
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
+const (
+	// FrameV1 prefixes each fragment with a 2-byte length, up to 64 KiB - 1.
+	FrameV1 = 1
+	// FrameV2 prefixes each fragment with a 4-byte length.
+	FrameV2 = 2
+
+	MaxFragmentSizeV1        = 0xFFFF
+	DefaultMaxFragmentSizeV2 = 1 << 20
+	// MinFrameSize is the smallest MaxFrameSize a Pipe accepts, frames carry
+	// up to 4096 bytes of packer overhead.
+	MinFrameSize = 8192
+)
+
+var (
+	ErrFragmentTooLarge = errors.New("fragment too large")
+	ErrDatagramTooLarge = errors.New("datagram too large")
+)
+
+// DatagramReader is implemented by conns that keep message boundaries, each
+// ReadDatagram returns exactly one datagram or ErrDatagramTooLarge if it does
+// not fit in b, in which case the datagram is discarded.
+type DatagramReader interface {
+	ReadDatagram(b []byte) (int, error)
+}
+
 func ReadFragment(src io.Reader) ([]byte, error) {
-	head := make([]byte, 2)
-	_, err := io.ReadFull(src, head)
+	return ReadFragmentVersion(src, FrameV1, MaxFragmentSizeV1)
+}
+
+func WriteFragment(dst io.Writer, b []byte) (int, error) {
+	return WriteFragmentVersion(dst, b, FrameV1, MaxFragmentSizeV1)
+}
+
+func ReadFragmentVersion(src io.Reader, version int, maxSize int) ([]byte, error) {
+	headLen, err := fragmentHeadLen(version)
 	if err != nil {
 		return nil, err
 	}
 
-	l := binary.LittleEndian.Uint16(head)
+	head := make([]byte, headLen)
+	_, err = io.ReadFull(src, head)
+	if err != nil {
+		return nil, err
+	}
+
+	var l int
+	if version == FrameV1 {
+		l = int(binary.LittleEndian.Uint16(head))
+	} else {
+		l64 := uint64(binary.LittleEndian.Uint32(head))
+		if l64 > uint64(maxSize) {
+			return nil, fmt.Errorf("%w: %v > %v", ErrFragmentTooLarge, l64, maxSize)
+		}
+		l = int(l64)
+	}
+	if l > maxSize {
+		return nil, fmt.Errorf("%w: %v > %v", ErrFragmentTooLarge, l, maxSize)
+	}
+
 	b := make([]byte, l)
 	_, err = io.ReadFull(src, b)
 	if err != nil {
@@ -21,10 +74,25 @@ func ReadFragment(src io.Reader) ([]byte, error) {
 	return b, err
 }
 
-func WriteFragment(dst io.Writer, b []byte) (int, error) {
+func WriteFragmentVersion(dst io.Writer, b []byte, version int, maxSize int) (int, error) {
+	headLen, err := fragmentHeadLen(version)
+	if err != nil {
+		return 0, err
+	}
+	if version == FrameV1 && maxSize > MaxFragmentSizeV1 {
+		maxSize = MaxFragmentSizeV1
+	}
+	if len(b) > maxSize {
+		return 0, fmt.Errorf("%w: %v > %v", ErrFragmentTooLarge, len(b), maxSize)
+	}
+
 	nTotal := 0
-	head := make([]byte, 2)
-	binary.LittleEndian.PutUint16(head, uint16(len(b)))
+	head := make([]byte, headLen)
+	if version == FrameV1 {
+		binary.LittleEndian.PutUint16(head, uint16(len(b)))
+	} else {
+		binary.LittleEndian.PutUint32(head, uint32(len(b)))
+	}
 
 	n1, err := dst.Write(head[:])
 	if n1 > 0 {
@@ -40,3 +108,14 @@ func WriteFragment(dst io.Writer, b []byte) (int, error) {
 	}
 	return nTotal, err
 }
+
+func fragmentHeadLen(version int) (int, error) {
+	switch version {
+	case FrameV1:
+		return 2, nil
+	case FrameV2:
+		return 4, nil
+	default:
+		return 0, fmt.Errorf("invalid frame version: %v", version)
+	}
+}
@@ -0,0 +1,224 @@
+package pipe
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dirSrcToDst = iota
+	dirDstToSrc
+)
+
+var directionNames = [...]string{"src_to_dst", "dst_to_src"}
+
+// dialBuckets are the upper bounds in seconds of the dial latency histogram.
+var dialBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// DropCounter is implemented by listeners that drop packets on their own,
+// such as protocol.UDPListener, the count is exported with the pipe's metrics.
+type DropCounter interface {
+	Dropped() uint64
+}
+
+// Metrics collects counters of every Pipe that has it set and serves them in
+// the Prometheus text exposition format, each labeled with the Pipe's Name.
+type Metrics struct {
+	mux   sync.Mutex
+	pipes []*pipeMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+type pipeMetrics struct {
+	name string
+
+	mux sync.Mutex
+	ln  net.Listener
+
+	sessionsActive  int64
+	sessionsTotal   uint64
+	rejected        uint64
+	acceptErrors    uint64
+	dialErrors      uint64
+	handshakeErrors uint64
+	bytes           [2]uint64
+	frames          [2]uint64
+	packErrors      uint64
+	unpackErrors    uint64
+
+	dialCount   uint64
+	dialSumNano uint64
+	dialBuckets []uint64
+}
+
+// register returns the counters for name, a Pipe restarted under the same
+// name keeps counting where it stopped.
+func (m *Metrics) register(name string, ln net.Listener) *pipeMetrics {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	var pm *pipeMetrics
+	for _, v := range m.pipes {
+		if v.name == name {
+			pm = v
+			break
+		}
+	}
+	if pm == nil {
+		pm = &pipeMetrics{name: name, dialBuckets: make([]uint64, len(dialBuckets))}
+		m.pipes = append(m.pipes, pm)
+	}
+	pm.mux.Lock()
+	pm.ln = ln
+	pm.mux.Unlock()
+	return pm
+}
+
+func (pm *pipeMetrics) observeDial(d time.Duration) {
+	if pm == nil {
+		return
+	}
+	atomic.AddUint64(&pm.dialCount, 1)
+	atomic.AddUint64(&pm.dialSumNano, uint64(d))
+	for i, le := range dialBuckets {
+		if d.Seconds() <= le {
+			atomic.AddUint64(&pm.dialBuckets[i], 1)
+		}
+	}
+}
+
+// the helpers below are no-ops on a nil *pipeMetrics, which is what a Pipe
+// without Metrics has
+
+func (pm *pipeMetrics) addActive(n int64) {
+	if pm == nil {
+		return
+	}
+	atomic.AddInt64(&pm.sessionsActive, n)
+	if n > 0 {
+		atomic.AddUint64(&pm.sessionsTotal, uint64(n))
+	}
+}
+
+func (pm *pipeMetrics) addCopied(dir int, n int) {
+	if pm == nil {
+		return
+	}
+	atomic.AddUint64(&pm.bytes[dir], uint64(n))
+	atomic.AddUint64(&pm.frames[dir], 1)
+}
+
+func (pm *pipeMetrics) incDialErrors() {
+	if pm != nil {
+		atomic.AddUint64(&pm.dialErrors, 1)
+	}
+}
+
+func (pm *pipeMetrics) incRejected() {
+	if pm != nil {
+		atomic.AddUint64(&pm.rejected, 1)
+	}
+}
+
+func (pm *pipeMetrics) incAcceptErrors() {
+	if pm != nil {
+		atomic.AddUint64(&pm.acceptErrors, 1)
+	}
+}
+
+func (pm *pipeMetrics) incHandshakeErrors() {
+	if pm != nil {
+		atomic.AddUint64(&pm.handshakeErrors, 1)
+	}
+}
+
+func (pm *pipeMetrics) incPackErrors() {
+	if pm != nil {
+		atomic.AddUint64(&pm.packErrors, 1)
+	}
+}
+
+func (pm *pipeMetrics) incUnpackErrors() {
+	if pm != nil {
+		atomic.AddUint64(&pm.unpackErrors, 1)
+	}
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := bufio.NewWriter(rw)
+	defer w.Flush()
+
+	m.mux.Lock()
+	pipes := append([]*pipeMetrics{}, m.pipes...)
+	m.mux.Unlock()
+
+	family := func(name, typ, help string, each func(pm *pipeMetrics, label string)) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, pm := range pipes {
+			each(pm, `pipe="`+escapeLabel(pm.name)+`"`)
+		}
+	}
+
+	family("pipe_sessions_active", "gauge", "Sessions currently open.", func(pm *pipeMetrics, l string) {
+		fmt.Fprintf(w, "pipe_sessions_active{%s} %d\n", l, atomic.LoadInt64(&pm.sessionsActive))
+	})
+	family("pipe_sessions_total", "counter", "Connections accepted.", func(pm *pipeMetrics, l string) {
+		fmt.Fprintf(w, "pipe_sessions_total{%s} %d\n", l, atomic.LoadUint64(&pm.sessionsTotal))
+	})
+	family("pipe_sessions_rejected_total", "counter", "Connections closed by admission control.", func(pm *pipeMetrics, l string) {
+		fmt.Fprintf(w, "pipe_sessions_rejected_total{%s} %d\n", l, atomic.LoadUint64(&pm.rejected))
+	})
+	family("pipe_accept_errors_total", "counter", "Listener Accept failures.", func(pm *pipeMetrics, l string) {
+		fmt.Fprintf(w, "pipe_accept_errors_total{%s} %d\n", l, atomic.LoadUint64(&pm.acceptErrors))
+	})
+	family("pipe_dial_errors_total", "counter", "Dials that failed.", func(pm *pipeMetrics, l string) {
+		fmt.Fprintf(w, "pipe_dial_errors_total{%s} %d\n", l, atomic.LoadUint64(&pm.dialErrors))
+	})
+	family("pipe_handshake_errors_total", "counter", "Handshakes that failed.", func(pm *pipeMetrics, l string) {
+		fmt.Fprintf(w, "pipe_handshake_errors_total{%s} %d\n", l, atomic.LoadUint64(&pm.handshakeErrors))
+	})
+	family("pipe_bytes_total", "counter", "Payload bytes copied.", func(pm *pipeMetrics, l string) {
+		for i, dir := range directionNames {
+			fmt.Fprintf(w, "pipe_bytes_total{%s,direction=%q} %d\n", l, dir, atomic.LoadUint64(&pm.bytes[i]))
+		}
+	})
+	family("pipe_frames_total", "counter", "Fragments written or read.", func(pm *pipeMetrics, l string) {
+		for i, dir := range directionNames {
+			fmt.Fprintf(w, "pipe_frames_total{%s,direction=%q} %d\n", l, dir, atomic.LoadUint64(&pm.frames[i]))
+		}
+	})
+	family("pipe_packer_errors_total", "counter", "Pack and Unpack failures.", func(pm *pipeMetrics, l string) {
+		fmt.Fprintf(w, "pipe_packer_errors_total{%s,op=\"pack\"} %d\n", l, atomic.LoadUint64(&pm.packErrors))
+		fmt.Fprintf(w, "pipe_packer_errors_total{%s,op=\"unpack\"} %d\n", l, atomic.LoadUint64(&pm.unpackErrors))
+	})
+	family("pipe_dial_duration_seconds", "histogram", "Dial latency.", func(pm *pipeMetrics, l string) {
+		for i, le := range dialBuckets {
+			fmt.Fprintf(w, "pipe_dial_duration_seconds_bucket{%s,le=\"%g\"} %d\n", l, le, atomic.LoadUint64(&pm.dialBuckets[i]))
+		}
+		count := atomic.LoadUint64(&pm.dialCount)
+		fmt.Fprintf(w, "pipe_dial_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, count)
+		fmt.Fprintf(w, "pipe_dial_duration_seconds_sum{%s} %g\n", l, time.Duration(atomic.LoadUint64(&pm.dialSumNano)).Seconds())
+		fmt.Fprintf(w, "pipe_dial_duration_seconds_count{%s} %d\n", l, count)
+	})
+	family("pipe_listener_dropped_total", "counter", "Packets dropped by the listener.", func(pm *pipeMetrics, l string) {
+		pm.mux.Lock()
+		dc, ok := pm.ln.(DropCounter)
+		pm.mux.Unlock()
+		if ok {
+			fmt.Fprintf(w, "pipe_listener_dropped_total{%s} %d\n", l, dc.Dropped())
+		}
+	})
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
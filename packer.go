@@ -1,6 +1,23 @@
 package pipe
 
+import "net"
+
 type Packer interface {
 	Pack(originData []byte) ([]byte, error)
 	Unpack(crypted []byte) ([]byte, error)
 }
+
+// SessionPacker is implemented by packers that keep per-session state, Pipe
+// calls NewSession once for every connection and uses the returned Packer for
+// both directions of that connection.
+type SessionPacker interface {
+	Packer
+	NewSession() Packer
+}
+
+// Handshaker runs on the transport connection of every session, after Dial,
+// and returns the Packer used for that session. isServer is true for the pipe
+// started by StartServer.
+type Handshaker interface {
+	Handshake(conn net.Conn, isServer bool) (Packer, error)
+}
@@ -0,0 +1,113 @@
+package packer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var ErrInvalidFrame = errors.New("invalid frame")
+
+// aead seals every frame with a fresh random nonce which is sent in front of
+// the ciphertext: nonce | ciphertext | tag.
+type aead struct {
+	once sync.Once
+	aead cipher.AEAD
+	err  error
+}
+
+func (a *aead) init(newAEAD func() (cipher.AEAD, error)) (cipher.AEAD, error) {
+	a.once.Do(func() {
+		a.aead, a.err = newAEAD()
+	})
+	return a.aead, a.err
+}
+
+func seal(c cipher.AEAD, originData []byte) ([]byte, error) {
+	nonceSize := c.NonceSize()
+	buf := make([]byte, nonceSize, nonceSize+len(originData)+c.Overhead())
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return c.Seal(buf, buf[:nonceSize], originData, nil), nil
+}
+
+func open(c cipher.AEAD, crypted []byte) ([]byte, error) {
+	nonceSize := c.NonceSize()
+	if len(crypted) < nonceSize+c.Overhead() {
+		return nil, ErrInvalidFrame
+	}
+	origData, err := c.Open(nil, crypted[:nonceSize], crypted[nonceSize:], nil)
+	if err != nil {
+		return nil, ErrInvalidFrame
+	}
+	return origData, nil
+}
+
+// AESGCM uses AES-GCM, Key must be 16, 24 or 32 bytes (32 for AES-256-GCM).
+type AESGCM struct {
+	Key []byte
+
+	aead
+}
+
+func (packer *AESGCM) cipher() (cipher.AEAD, error) {
+	return packer.init(func() (cipher.AEAD, error) {
+		block, err := aes.NewCipher(packer.Key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	})
+}
+
+func (packer *AESGCM) Pack(originData []byte) ([]byte, error) {
+	c, err := packer.cipher()
+	if err != nil {
+		return nil, err
+	}
+	return seal(c, originData)
+}
+
+func (packer *AESGCM) Unpack(crypted []byte) ([]byte, error) {
+	c, err := packer.cipher()
+	if err != nil {
+		return nil, err
+	}
+	return open(c, crypted)
+}
+
+// ChaCha20Poly1305 uses XChaCha20-Poly1305 so that random nonces are safe for
+// long-lived keys, Key must be 32 bytes.
+type ChaCha20Poly1305 struct {
+	Key []byte
+
+	aead
+}
+
+func (packer *ChaCha20Poly1305) cipher() (cipher.AEAD, error) {
+	return packer.init(func() (cipher.AEAD, error) {
+		return chacha20poly1305.NewX(packer.Key)
+	})
+}
+
+func (packer *ChaCha20Poly1305) Pack(originData []byte) ([]byte, error) {
+	c, err := packer.cipher()
+	if err != nil {
+		return nil, err
+	}
+	return seal(c, originData)
+}
+
+func (packer *ChaCha20Poly1305) Unpack(crypted []byte) ([]byte, error) {
+	c, err := packer.cipher()
+	if err != nil {
+		return nil, err
+	}
+	return open(c, crypted)
+}
@@ -0,0 +1,342 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/lesismal/pipe"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrHandshakeConfig   = errors.New("handshake requires a PSK or identity keys")
+	ErrHandshakeFailed   = errors.New("handshake failed")
+	ErrHandshakeIdentity = errors.New("handshake peer identity rejected")
+	ErrHandshakePSK      = errors.New("handshake PSK must be at least 32 random bytes")
+)
+
+const (
+	handshakeVersion   = 2
+	handshakeNonceSize = 32
+	handshakeMinPSK    = 32
+	handshakeLabel     = "lesismal/pipe handshake v1"
+)
+
+// Handshake implements pipe.Handshaker with an ephemeral X25519 key agreement
+// that gives every connection its own session keys (forward secrecy).
+//
+// The exchange is authenticated by PSK, which must be the same on both ends
+// and at least 32 random bytes, and/or by Ed25519 identities: each end signs
+// the transcript with PrivateKey and only accepts peers whose public key is in
+// PeerKeys.
+//
+//	client -> server: version | client ephemeral | client nonce | binder
+//	server -> client: server ephemeral | server nonce | identity | server finished
+//	client -> server: identity | client finished
+//
+// where identity is 0, or 1 | Ed25519 public key | signature of the transcript.
+// The binder, a MAC of the hello under the PSK, is only sent when a PSK is set
+// and lets the server drop clients that don't know it before replying.
+// Session keys, one per direction, are passed to NewPacker which defaults to
+// AESGCM.
+type Handshake struct {
+	PSK        []byte
+	PrivateKey ed25519.PrivateKey
+	PeerKeys   []ed25519.PublicKey
+	NewPacker  func(key []byte) (pipe.Packer, error)
+	Timeout    time.Duration
+}
+
+type handshakeKeys struct {
+	transcript     []byte
+	clientKey      []byte
+	serverKey      []byte
+	clientFinished []byte
+	serverFinished []byte
+}
+
+func (h *Handshake) Handshake(conn net.Conn, isServer bool) (pipe.Packer, error) {
+	if len(h.PSK) == 0 && (len(h.PrivateKey) == 0 || len(h.PeerKeys) == 0) {
+		return nil, ErrHandshakeConfig
+	}
+	if len(h.PSK) > 0 && len(h.PSK) < handshakeMinPSK {
+		return nil, ErrHandshakePSK
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var keys *handshakeKeys
+	var err error
+	if isServer {
+		keys, err = h.serverHandshake(conn)
+	} else {
+		keys, err = h.clientHandshake(conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	newPacker := h.NewPacker
+	if newPacker == nil {
+		newPacker = func(key []byte) (pipe.Packer, error) {
+			return &AESGCM{Key: key}, nil
+		}
+	}
+	tx, err := newPacker(keys.clientKey)
+	if err != nil {
+		return nil, err
+	}
+	rx, err := newPacker(keys.serverKey)
+	if err != nil {
+		return nil, err
+	}
+	if isServer {
+		tx, rx = rx, tx
+	}
+	return &duplex{tx: tx, rx: rx}, nil
+}
+
+func (h *Handshake) clientHandshake(conn net.Conn) (*handshakeKeys, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, handshakeNonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := append([]byte{handshakeVersion}, eph.PublicKey().Bytes()...)
+	hello = append(hello, nonce...)
+	hello = append(hello, h.binder(hello)...)
+	_, err = pipe.WriteFragment(conn, hello)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := pipe.ReadFragment(conn)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(reply)
+	peerEph, peerNonce := make([]byte, 32), make([]byte, handshakeNonceSize)
+	if _, err = io.ReadFull(r, peerEph); err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	if _, err = io.ReadFull(r, peerNonce); err != nil {
+		return nil, ErrHandshakeFailed
+	}
+
+	keys, err := h.deriveKeys(eph, peerEph, eph.PublicKey().Bytes(), nonce, peerEph, peerNonce)
+	if err != nil {
+		return nil, err
+	}
+	err = h.verifyIdentity(r, keys.transcript, true)
+	if err != nil {
+		return nil, err
+	}
+	finished := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(r, finished); err != nil || r.Len() != 0 {
+		return nil, ErrHandshakeFailed
+	}
+	if !hmac.Equal(finished, keys.serverFinished) {
+		return nil, ErrHandshakeFailed
+	}
+
+	msg := append(h.identity(keys.transcript, false), keys.clientFinished...)
+	_, err = pipe.WriteFragment(conn, msg)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (h *Handshake) serverHandshake(conn net.Conn) (*handshakeKeys, error) {
+	hello, err := pipe.ReadFragment(conn)
+	if err != nil {
+		return nil, err
+	}
+	helloSize := 1 + 32 + handshakeNonceSize
+	if len(hello) != helloSize+len(h.binder(nil)) || hello[0] != handshakeVersion {
+		return nil, ErrHandshakeFailed
+	}
+	if !hmac.Equal(hello[helloSize:], h.binder(hello[:helloSize])) {
+		return nil, ErrHandshakeFailed
+	}
+	peerEph, peerNonce := hello[1:33], hello[33:helloSize]
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, handshakeNonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := h.deriveKeys(eph, peerEph, peerEph, peerNonce, eph.PublicKey().Bytes(), nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := append(eph.PublicKey().Bytes(), nonce...)
+	reply = append(reply, h.identity(keys.transcript, true)...)
+	reply = append(reply, keys.serverFinished...)
+	_, err = pipe.WriteFragment(conn, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := pipe.ReadFragment(conn)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(msg)
+	err = h.verifyIdentity(r, keys.transcript, false)
+	if err != nil {
+		return nil, err
+	}
+	finished := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(r, finished); err != nil || r.Len() != 0 {
+		return nil, ErrHandshakeFailed
+	}
+	if !hmac.Equal(finished, keys.clientFinished) {
+		return nil, ErrHandshakeFailed
+	}
+	return keys, nil
+}
+
+func (h *Handshake) deriveKeys(eph *ecdh.PrivateKey, peerEph, clientEph, clientNonce, serverEph, serverNonce []byte) (*handshakeKeys, error) {
+	peerPub, err := ecdh.X25519().NewPublicKey(peerEph)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	shared, err := eph.ECDH(peerPub)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+
+	th := sha256.New()
+	th.Write([]byte(handshakeLabel))
+	th.Write(clientEph)
+	th.Write(clientNonce)
+	th.Write(serverEph)
+	th.Write(serverNonce)
+	transcript := th.Sum(nil)
+
+	kdf := hkdf.New(sha256.New, shared, h.PSK, transcript)
+	keys := &handshakeKeys{
+		transcript:     transcript,
+		clientKey:      make([]byte, 32),
+		serverKey:      make([]byte, 32),
+		clientFinished: make([]byte, 32),
+		serverFinished: make([]byte, 32),
+	}
+	for _, k := range [][]byte{keys.clientKey, keys.serverKey, keys.clientFinished, keys.serverFinished} {
+		if _, err = io.ReadFull(kdf, k); err != nil {
+			return nil, err
+		}
+	}
+
+	keys.clientFinished = handshakeMAC(keys.clientFinished, transcript)
+	keys.serverFinished = handshakeMAC(keys.serverFinished, transcript)
+	return keys, nil
+}
+
+// binder proves the client knows the PSK, it is empty without one.
+func (h *Handshake) binder(hello []byte) []byte {
+	if len(h.PSK) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, h.PSK)
+	mac.Write([]byte(handshakeLabel + " binder"))
+	mac.Write(hello)
+	return mac.Sum(nil)
+}
+
+// identity is a flag byte followed by the public key and signature if set.
+func (h *Handshake) identity(transcript []byte, isServer bool) []byte {
+	if len(h.PrivateKey) == 0 {
+		return []byte{0}
+	}
+	pub := h.PrivateKey.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(h.PrivateKey, handshakeSigned(transcript, isServer))
+	return append(append([]byte{1}, pub...), sig...)
+}
+
+func (h *Handshake) verifyIdentity(r *bytes.Reader, transcript []byte, isServer bool) error {
+	flag, err := r.ReadByte()
+	if err != nil || flag > 1 {
+		return ErrHandshakeFailed
+	}
+	if flag == 0 {
+		if len(h.PeerKeys) > 0 {
+			return ErrHandshakeIdentity
+		}
+		return nil
+	}
+	pub := make([]byte, ed25519.PublicKeySize)
+	sig := make([]byte, ed25519.SignatureSize)
+	if _, err = io.ReadFull(r, pub); err != nil {
+		return ErrHandshakeIdentity
+	}
+	if _, err = io.ReadFull(r, sig); err != nil {
+		return ErrHandshakeIdentity
+	}
+	if len(h.PeerKeys) == 0 {
+		return nil
+	}
+	for _, key := range h.PeerKeys {
+		if bytes.Equal(key, pub) {
+			if ed25519.Verify(key, handshakeSigned(transcript, isServer), sig) {
+				return nil
+			}
+			break
+		}
+	}
+	return ErrHandshakeIdentity
+}
+
+func handshakeSigned(transcript []byte, isServer bool) []byte {
+	role := byte('c')
+	if isServer {
+		role = 's'
+	}
+	return append([]byte{role}, transcript...)
+}
+
+func handshakeMAC(key, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// duplex packs with tx and unpacks with rx, so that each direction of a
+// session uses its own key.
+type duplex struct {
+	tx pipe.Packer
+	rx pipe.Packer
+}
+
+func (d *duplex) Pack(originData []byte) ([]byte, error) {
+	return d.tx.Pack(originData)
+}
+
+func (d *duplex) Unpack(crypted []byte) ([]byte, error) {
+	return d.rx.Unpack(crypted)
+}
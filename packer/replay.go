@@ -0,0 +1,231 @@
+package packer
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lesismal/pipe"
+)
+
+var (
+	ErrReplayedFrame   = errors.New("replayed frame")
+	ErrReplayedSession = errors.New("replayed session")
+	ErrExpiredSession  = errors.New("expired session")
+)
+
+const (
+	replayNonceSize = 16
+	replayHeadSize  = replayNonceSize + 8 + 8
+	replayMaxWindow = 64
+)
+
+// Replay wraps another packer and prefixes every frame with the sender's
+// session nonce, the time the session sent its first frame and a
+// per-direction sequence number, before the inner packer seals it. The inner
+// packer must authenticate its output (AESGCM, ChaCha20Poly1305), or the
+// header can be forged.
+//
+// The receiver rejects frames whose sequence number was already seen or fell
+// out of the sliding Window, and the first frame of sessions whose nonce was
+// already seen within MaxAge or whose first frame was sent more than MaxAge
+// ago. The nonces of the sessions it sends from count as seen, so a frame
+// reflected back to its sender is rejected as well.
+type Replay struct {
+	Packer pipe.Packer
+	Window int
+	MaxAge time.Duration
+
+	mux       sync.Mutex
+	seen      map[[replayNonceSize]byte]time.Time
+	lastClean time.Time
+	session   *ReplaySession
+}
+
+func (r *Replay) NewSession() pipe.Packer {
+	s := &ReplaySession{parent: r}
+	_, err := rand.Read(s.nonce[:])
+	if err != nil {
+		s.err = err
+	}
+	return s
+}
+
+func (r *Replay) Pack(originData []byte) ([]byte, error) {
+	return r.defaultSession().Pack(originData)
+}
+
+func (r *Replay) Unpack(crypted []byte) ([]byte, error) {
+	return r.defaultSession().Unpack(crypted)
+}
+
+func (r *Replay) defaultSession() *ReplaySession {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.session == nil {
+		r.session = r.NewSession().(*ReplaySession)
+	}
+	return r.session
+}
+
+func (r *Replay) window() uint64 {
+	if r.Window <= 0 || r.Window > replayMaxWindow {
+		return replayMaxWindow
+	}
+	return uint64(r.Window)
+}
+
+func (r *Replay) maxAge() time.Duration {
+	if r.MaxAge <= 0 {
+		return 2 * time.Minute
+	}
+	return r.MaxAge
+}
+
+func (r *Replay) register(nonce [replayNonceSize]byte, start int64) error {
+	now := time.Now()
+	maxAge := r.maxAge()
+	age := now.Sub(time.Unix(0, start))
+	if age > maxAge || age < -maxAge {
+		return ErrExpiredSession
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.seen == nil {
+		r.seen = map[[replayNonceSize]byte]time.Time{}
+	}
+	if now.Sub(r.lastClean) > maxAge {
+		for k, t := range r.seen {
+			if now.Sub(t) > 2*maxAge {
+				delete(r.seen, k)
+			}
+		}
+		r.lastClean = now
+	}
+	if _, ok := r.seen[nonce]; ok {
+		return ErrReplayedSession
+	}
+	r.seen[nonce] = now
+	return nil
+}
+
+// claim marks the nonce of a local session as seen once it sends, so its
+// frames are rejected if they are reflected back.
+func (r *Replay) claim(nonce [replayNonceSize]byte) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.seen == nil {
+		r.seen = map[[replayNonceSize]byte]time.Time{}
+	}
+	r.seen[nonce] = time.Now()
+}
+
+type ReplaySession struct {
+	parent *Replay
+	err    error
+
+	sendMux sync.Mutex
+	nonce   [replayNonceSize]byte
+	start   int64
+	sendSeq uint64
+
+	recvMux   sync.Mutex
+	peerKnown bool
+	peerNonce [replayNonceSize]byte
+	recvSeq   uint64
+	recvMask  uint64
+}
+
+func (s *ReplaySession) Pack(originData []byte) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	s.sendMux.Lock()
+	if s.sendSeq == 0 {
+		// stamped on the first frame, a direction may stay idle for long
+		s.start = time.Now().UnixNano()
+		s.parent.claim(s.nonce)
+	}
+	s.sendSeq++
+	seq := s.sendSeq
+	start := s.start
+	s.sendMux.Unlock()
+
+	buf := make([]byte, replayHeadSize+len(originData))
+	copy(buf, s.nonce[:])
+	binary.LittleEndian.PutUint64(buf[replayNonceSize:], uint64(start))
+	binary.LittleEndian.PutUint64(buf[replayNonceSize+8:], seq)
+	copy(buf[replayHeadSize:], originData)
+	return s.parent.Packer.Pack(buf)
+}
+
+func (s *ReplaySession) Unpack(crypted []byte) ([]byte, error) {
+	b, err := s.parent.Packer.Unpack(crypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < replayHeadSize {
+		return nil, ErrInvalidFrame
+	}
+
+	var nonce [replayNonceSize]byte
+	copy(nonce[:], b)
+	start := int64(binary.LittleEndian.Uint64(b[replayNonceSize:]))
+	seq := binary.LittleEndian.Uint64(b[replayNonceSize+8:])
+	if seq == 0 {
+		return nil, ErrInvalidFrame
+	}
+	if nonce == s.nonce {
+		// our own frame sent back to us
+		return nil, ErrReplayedFrame
+	}
+
+	s.recvMux.Lock()
+	defer s.recvMux.Unlock()
+	if !s.peerKnown {
+		err = s.parent.register(nonce, start)
+		if err != nil {
+			return nil, err
+		}
+		s.peerKnown = true
+		s.peerNonce = nonce
+	} else if nonce != s.peerNonce {
+		return nil, ErrReplayedFrame
+	}
+
+	err = s.accept(seq)
+	if err != nil {
+		return nil, err
+	}
+	return b[replayHeadSize:], nil
+}
+
+// accept slides the receive window, bit i of recvMask records recvSeq-i.
+func (s *ReplaySession) accept(seq uint64) error {
+	window := s.parent.window()
+	switch {
+	case seq > s.recvSeq:
+		shift := seq - s.recvSeq
+		if shift >= replayMaxWindow {
+			s.recvMask = 0
+		} else {
+			s.recvMask <<= shift
+		}
+		s.recvMask |= 1
+		s.recvSeq = seq
+		return nil
+	case s.recvSeq-seq >= window:
+		return ErrReplayedFrame
+	default:
+		bit := uint64(1) << (s.recvSeq - seq)
+		if s.recvMask&bit != 0 {
+			return ErrReplayedFrame
+		}
+		s.recvMask |= bit
+		return nil
+	}
+}
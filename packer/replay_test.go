@@ -0,0 +1,118 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lesismal/pipe"
+)
+
+func newTestReplay(window int, maxAge time.Duration) *Replay {
+	return &Replay{
+		Packer: &AESGCM{Key: bytes.Repeat([]byte{7}, 32)},
+		Window: window,
+		MaxAge: maxAge,
+	}
+}
+
+func packN(t *testing.T, s pipe.Packer, n int) [][]byte {
+	frames := make([][]byte, n)
+	for i := range frames {
+		b, err := s.Pack([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames[i] = b
+	}
+	return frames
+}
+
+func TestReplayWindow(t *testing.T) {
+	sender := newTestReplay(4, 0).NewSession()
+	receiver := newTestReplay(4, 0).NewSession()
+	frames := packN(t, sender, 8)
+
+	tests := []struct {
+		name  string
+		frame int
+		err   error
+	}{
+		{"first", 0, nil},
+		{"ahead", 5, nil},
+		{"behind within window", 3, nil},
+		{"duplicate", 3, ErrReplayedFrame},
+		{"duplicate newest", 5, ErrReplayedFrame},
+		{"out of window", 1, ErrReplayedFrame},
+		{"next", 6, nil},
+		{"last gap in window", 4, nil},
+	}
+	for _, tt := range tests {
+		b, err := receiver.Unpack(frames[tt.frame])
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%v: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && !bytes.Equal(b, []byte{byte(tt.frame)}) {
+			t.Fatalf("%v: got payload %v, want %v", tt.name, b, tt.frame)
+		}
+	}
+}
+
+func TestReplaySession(t *testing.T) {
+	sender := newTestReplay(0, 0).NewSession()
+	server := newTestReplay(0, 0)
+	frames := packN(t, sender, 2)
+
+	first := server.NewSession()
+	for _, b := range frames {
+		if _, err := first.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the whole session recorded and replayed against a new session
+	replayed := server.NewSession()
+	if _, err := replayed.Unpack(frames[0]); !errors.Is(err, ErrReplayedSession) {
+		t.Fatalf("got error %v, want %v", err, ErrReplayedSession)
+	}
+
+	// a frame of another session injected into a known one
+	other := packN(t, newTestReplay(0, 0).NewSession(), 1)
+	if _, err := first.Unpack(other[0]); !errors.Is(err, ErrReplayedFrame) {
+		t.Fatalf("got error %v, want %v", err, ErrReplayedFrame)
+	}
+}
+
+func TestReplayExpiredSession(t *testing.T) {
+	r := newTestReplay(0, time.Minute)
+	for _, age := range []time.Duration{2 * time.Minute, -2 * time.Minute} {
+		buf := make([]byte, replayHeadSize)
+		buf[0] = 1
+		binary.LittleEndian.PutUint64(buf[replayNonceSize:], uint64(time.Now().Add(-age).UnixNano()))
+		binary.LittleEndian.PutUint64(buf[replayNonceSize+8:], 1)
+		b, err := r.Packer.Pack(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = r.NewSession().Unpack(b); !errors.Is(err, ErrExpiredSession) {
+			t.Fatalf("age %v: got error %v, want %v", age, err, ErrExpiredSession)
+		}
+	}
+}
+
+func TestReplayReflection(t *testing.T) {
+	r := newTestReplay(0, 0)
+	client := r.NewSession()
+	b, err := client.Pack([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Unpack(b); !errors.Is(err, ErrReplayedFrame) {
+		t.Fatalf("reflected to its session: got error %v, want %v", err, ErrReplayedFrame)
+	}
+	if _, err = r.NewSession().Unpack(b); !errors.Is(err, ErrReplayedSession) {
+		t.Fatalf("reflected to another session: got error %v, want %v", err, ErrReplayedSession)
+	}
+}
@@ -1,25 +1,67 @@
 package pipe
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
 )
 
+var (
+	ErrPipeNotRunning = errors.New("pipe not running")
+	ErrMaxFrameSize   = fmt.Errorf("MaxFrameSize must be at least %v", MinFrameSize)
+)
+
 type Pipe struct {
 	mux sync.Mutex
 
-	running  bool
-	ln       net.Listener
-	conns    map[net.Conn]net.Conn
-	isServer bool
+	running   bool
+	accepting bool
+	ln        net.Listener
+	conns     map[net.Conn]*liveSession
+	perIP     map[string]int
+	nextID    uint64
+	acceptErr error
+	isServer  bool
+	sessions  *sync.WaitGroup
+	chAccept  chan struct{}
+	stats     *pipeMetrics
 
 	Listen         func() (net.Listener, error)
 	Dial           func(net.Conn) (net.Conn, error)
 	Packer         Packer
+	Handshake      Handshaker
 	Timeout        time.Duration
 	ReadBufferSize int
+	FrameVersion   int
+	MaxFrameSize   int
+
+	// Datagram maps each datagram read from the raw side to exactly one frame
+	// and writes each frame back as one datagram. Datagrams larger than
+	// ReadBufferSize are dropped instead of being split.
+	Datagram bool
+
+	Logger Logger
+	Hooks  Hooks
+
+	// Name labels this pipe's metrics, it defaults to the listener address.
+	Name    string
+	Metrics *Metrics
+
+	RateLimiter *RateLimiter
+
+	// MaxSessions and MaxSessionsPerIP cap concurrent sessions, connections
+	// over a cap are closed right after Accept. AcceptRate limits accepted
+	// connections per second, the rest wait in the listener's backlog. Zero
+	// means unlimited.
+	MaxSessions      int
+	MaxSessionsPerIP int
+	AcceptRate       int
+
+	// ACL rejects connections by source IP right after Accept, before Dial.
+	ACL *ACL
 }
 
 func (p *Pipe) StartServer() error {
@@ -37,189 +79,497 @@ func (p *Pipe) start(isServer bool) error {
 		return nil
 	}
 
-	p.running = true
 	p.isServer = isServer
 
-	p.initConfig()
+	err := p.initConfig()
+	if err != nil {
+		return err
+	}
+
+	ln, err := p.Listen()
+	if err != nil {
+		return err
+	}
+
+	p.running = true
+	p.accepting = true
+	p.acceptErr = nil
+	p.ln = ln
+	if p.Metrics != nil {
+		if p.Name == "" && ln.Addr() != nil {
+			p.Name = ln.Addr().String()
+		}
+		p.stats = p.Metrics.register(p.Name, ln)
+	}
+	// a fresh group per start, a Shutdown that timed out may still be waiting
+	// on the previous one
+	p.sessions = &sync.WaitGroup{}
+	p.chAccept = make(chan struct{})
+	go p.accept(ln, p.chAccept)
+
+	return nil
+}
+
+// Serve blocks until ctx is done or the listener stops, then stops accepting
+// new connections. Sessions already in flight keep running until Shutdown.
+// If the listener failed with a permanent error, Serve returns it.
+func (p *Pipe) Serve(ctx context.Context) error {
+	p.mux.Lock()
+	chAccept := p.chAccept
+	running := p.running
+	p.mux.Unlock()
+	if !running {
+		return ErrPipeNotRunning
+	}
+
+	select {
+	case <-chAccept:
+		p.mux.Lock()
+		defer p.mux.Unlock()
+		return p.acceptErr
+	case <-ctx.Done():
+		p.stopAccept()
+		<-chAccept
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting and waits for in-flight sessions to finish. If ctx
+// is done first, the remaining sessions are closed and ctx.Err() is returned
+// right away, sessions still inside Dial are not waited for and close their
+// dst as soon as Dial returns.
+func (p *Pipe) Shutdown(ctx context.Context) error {
+	p.mux.Lock()
+	if !p.running {
+		p.mux.Unlock()
+		return nil
+	}
+	chAccept := p.chAccept
+	sessions := p.sessions
+	p.mux.Unlock()
+
+	p.stopAccept()
+	<-chAccept
+
+	chDrained := make(chan struct{})
+	go func() {
+		sessions.Wait()
+		close(chDrained)
+	}()
 
 	var err error
-	p.ln, err = p.Listen()
-	if err == nil {
-		go p.accept()
+	select {
+	case <-chDrained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		p.closeConns()
 	}
+
+	p.mux.Lock()
+	p.running = false
+	p.mux.Unlock()
+
 	return err
 }
 
 func (p *Pipe) Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.Shutdown(ctx)
+}
+
+func (p *Pipe) stopAccept() {
 	p.mux.Lock()
 	defer p.mux.Unlock()
-	if !p.running {
+	if !p.accepting {
 		return
 	}
-	p.running = false
-
+	p.accepting = false
 	if p.ln != nil {
 		p.ln.Close()
 	}
+}
+
+func (p *Pipe) closeConns() {
+	var conns []net.Conn
+	p.mux.Lock()
+	for _, s := range p.conns {
+		conns = append(conns, s.close()...)
+	}
+	p.mux.Unlock()
+	closeAll(conns)
+}
+
+func (p *Pipe) isAccepting() bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.accepting
+}
 
+func (p *Pipe) addConn(src net.Conn) (*liveSession, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if !p.accepting {
+		return nil, ErrPipeNotRunning
+	}
 	if p.conns == nil {
-		return
+		p.conns = map[net.Conn]*liveSession{}
+		p.perIP = map[string]int{}
 	}
+	if !p.ACL.AllowedAddr(src.RemoteAddr()) {
+		return nil, ErrAccessDenied
+	}
+	ip := hostOf(src.RemoteAddr())
+	if p.MaxSessions > 0 && len(p.conns) >= p.MaxSessions {
+		return nil, ErrTooManySessions
+	}
+	if p.MaxSessionsPerIP > 0 && p.perIP[ip] >= p.MaxSessionsPerIP {
+		return nil, ErrTooManySessionsPerIP
+	}
+	p.nextID++
+	s := newLiveSession(p.nextID, src, ip, p.stats)
+	p.conns[src] = s
+	p.perIP[ip]++
+	s.wg = p.sessions
+	s.wg.Add(1)
+	p.stats.addActive(1)
+	return s, nil
+}
 
-	for src, dst := range p.conns {
-		src.Close()
-		dst.Close()
+// removeConn must be called with p.mux held.
+func (p *Pipe) removeConn(s *liveSession) {
+	if _, ok := p.conns[s.Src]; !ok {
+		return
+	}
+	delete(p.conns, s.Src)
+	if p.perIP[s.ip]--; p.perIP[s.ip] <= 0 {
+		delete(p.perIP, s.ip)
 	}
-	p.conns = nil
 }
 
-func (p *Pipe) initConfig() {
+func (p *Pipe) initConfig() error {
 	if p.Timeout <= 0 {
 		p.Timeout = 60 * time.Second
 	}
+	if p.FrameVersion <= 0 {
+		p.FrameVersion = FrameV1
+	}
+	if p.MaxFrameSize > 0 && p.MaxFrameSize < MinFrameSize {
+		return ErrMaxFrameSize
+	}
+	// leave room for the packer's overhead
+	maxReadBufferSize := 32768
+	switch p.FrameVersion {
+	case FrameV1:
+		if p.MaxFrameSize <= 0 || p.MaxFrameSize > MaxFragmentSizeV1 {
+			p.MaxFrameSize = MaxFragmentSizeV1
+		}
+		if p.MaxFrameSize-4096 < maxReadBufferSize {
+			maxReadBufferSize = p.MaxFrameSize - 4096
+		}
+	default:
+		if p.MaxFrameSize <= 0 {
+			p.MaxFrameSize = DefaultMaxFragmentSizeV2
+		}
+		maxReadBufferSize = p.MaxFrameSize - 4096
+	}
 	if p.ReadBufferSize <= 0 {
 		p.ReadBufferSize = 4096
+		if p.Datagram {
+			// room for the largest UDP payload if the frame allows it
+			p.ReadBufferSize = 65507
+		}
 	}
-	if p.ReadBufferSize > 32768 {
-		p.ReadBufferSize = 32768
+	if p.ReadBufferSize > maxReadBufferSize {
+		p.ReadBufferSize = maxReadBufferSize
 	}
-	log.Printf("Pipe Start with [timeout: %v seconds, read buffer: %v]", p.Timeout.Seconds(), p.ReadBufferSize)
-
+	p.logger().Info("pipe start", "server", p.isServer, "timeout", p.Timeout, "read_buffer", p.ReadBufferSize, "frame_version", p.FrameVersion, "max_frame_size", p.MaxFrameSize, "datagram", p.Datagram)
+	return nil
 }
 
-func (p *Pipe) accept() error {
-	var err error
-	var src net.Conn
-	for p.running {
-		src, err = p.ln.Accept()
-		if err == nil {
-			log.Printf("Accept: [local %v, remote %v]", src.LocalAddr(), src.RemoteAddr())
-			go p.serve(src)
+func (p *Pipe) accept(ln net.Listener, chAccept chan struct{}) {
+	defer close(chAccept)
+
+	var rate *bucket
+	if p.AcceptRate > 0 {
+		rate = newBucket(int64(p.AcceptRate))
+	}
+	var backoff time.Duration
+	for p.isAccepting() {
+		if rate != nil {
+			if d := rate.reserve(1); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		src, err := ln.Accept()
+		if err != nil {
+			if !p.isAccepting() {
+				return
+			}
+			if isTemporary(err) {
+				backoff = nextBackoff(backoff)
+				p.stats.incAcceptErrors()
+				p.logger().Warn("accept failed, retrying", "err", err, "backoff", backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			p.stats.incAcceptErrors()
+			p.logger().Error("accept failed", "err", err)
+			p.mux.Lock()
+			p.acceptErr = err
+			p.mux.Unlock()
+			p.stopAccept()
+			return
+		}
+		backoff = 0
+
+		s, err := p.addConn(src)
+		if err == ErrPipeNotRunning {
+			src.Close()
+			return
+		}
+		if err != nil {
+			p.stats.incRejected()
+			p.logger().Warn("session rejected", "local", src.LocalAddr().String(), "remote", src.RemoteAddr().String(), "err", err)
+			if p.Hooks.OnReject != nil {
+				p.Hooks.OnReject(src, err)
+			}
+			src.Close()
+			continue
+		}
+		p.logger().Debug("accept", "local", src.LocalAddr().String(), "remote", src.RemoteAddr().String())
+		if p.Hooks.OnAccept != nil {
+			p.Hooks.OnAccept(src)
 		}
+		go p.serve(s)
 	}
-	return err
 }
 
-func (p *Pipe) serve(src net.Conn) {
-	defer Recover()
+func (p *Pipe) serve(s *liveSession) {
+	defer s.wg.Done()
+	defer p.stats.addActive(-1)
+	log := p.logger()
+	defer RecoverTo(log)
+
+	src := s.Src
 
+	// the server authenticates its peer before dialing, so an unauthenticated
+	// client can neither make it dial nor pick the destination
+	packer := p.Packer
+	if p.Handshake != nil && p.isServer {
+		var err error
+		packer, err = p.Handshake.Handshake(src, true)
+		if err != nil {
+			p.stats.incHandshakeErrors()
+			log.Warn("handshake failed", "local", src.LocalAddr().String(), "remote", src.RemoteAddr().String(), "err", err)
+			src.Close()
+			p.mux.Lock()
+			p.removeConn(s)
+			p.mux.Unlock()
+			return
+		}
+	}
+
+	if p.Hooks.OnDialStart != nil {
+		p.Hooks.OnDialStart(src)
+	}
+	dialStart := time.Now()
 	dst, err := p.Dial(src)
+	p.stats.observeDial(time.Since(dialStart))
 	if err != nil {
-		log.Printf("[local %v, remote %v] Dial failed: %v", src.LocalAddr(), src.RemoteAddr(), err)
+		p.stats.incDialErrors()
+		log.Warn("dial failed", "local", src.LocalAddr().String(), "remote", src.RemoteAddr().String(), "err", err)
+		if p.Hooks.OnDialError != nil {
+			p.Hooks.OnDialError(src, err)
+		}
 		src.Close()
+		p.mux.Lock()
+		p.removeConn(s)
+		p.mux.Unlock()
 		return
 	}
-	log.Printf("[local %v, remote %v] Dial success", src.LocalAddr(), src.RemoteAddr())
+	log.Debug("dial success", "local", src.LocalAddr().String(), "remote", src.RemoteAddr().String())
 
 	p.mux.Lock()
-	if p.conns == nil {
-		p.conns = map[net.Conn]net.Conn{}
+	select {
+	case <-s.done:
+		// closed by Shutdown or CloseSession while dialing
+		p.removeConn(s)
+		p.mux.Unlock()
+		dst.Close()
+		return
+	default:
+	}
+	s.Dst = dst
+	if p.RateLimiter != nil {
+		s.limiter = p.RateLimiter.newSession(src)
+		defer p.RateLimiter.release(s.limiter)
 	}
-	p.conns[src] = dst
 	p.mux.Unlock()
 
 	closePipe := func() {
-		src.Close()
-		dst.Close()
-
 		p.mux.Lock()
-		delete(p.conns, src)
+		conns := s.close()
+		p.removeConn(s)
 		p.mux.Unlock()
+		closeAll(conns)
 	}
 
-	srcLocalAddr := src.LocalAddr().String()
-	srcRemoteAddr := src.RemoteAddr().String()
-	dstLocalAddr := dst.LocalAddr().String()
-	dstRemoteAddr := dst.RemoteAddr().String()
-	defer closePipe()
+	if p.Handshake != nil && !p.isServer {
+		packer, err = p.Handshake.Handshake(dst, false)
+		if err != nil {
+			p.stats.incHandshakeErrors()
+			log.Warn("handshake failed", "local", dst.LocalAddr().String(), "remote", dst.RemoteAddr().String(), "err", err)
+			closePipe()
+			return
+		}
+	}
+	if sp, ok := packer.(SessionPacker); ok {
+		packer = sp.NewSession()
+	}
+
+	session := s.Session
+	if p.Hooks.OnSessionOpen != nil {
+		p.Hooks.OnSessionOpen(&session)
+	}
+	addrs := []any{"id", s.ID, "src_remote", src.RemoteAddr().String(), "src_local", src.LocalAddr().String(), "dst_local", dst.LocalAddr().String(), "dst_remote", dst.RemoteAddr().String()}
+	log.Info("session open", addrs...)
 
+	var (
+		srcToDst, dstToSrc int64
+		errSrc, errDst     error
+		chDone             = make(chan struct{})
+	)
+	go func() {
+		defer close(chDone)
+		defer RecoverTo(log)
+		defer closePipe()
+		if p.isServer {
+			dstToSrc, errDst = p.copyRawToFragment(src, dst, packer, s, dirDstToSrc)
+		} else {
+			dstToSrc, errDst = p.copyFragmentToRaw(src, dst, packer, s, dirDstToSrc)
+		}
+	}()
 	if p.isServer {
-		go func() {
-			defer Recover()
-			defer closePipe()
-			log.Printf("[svr] [dst remote %v -> dst local %v -> src local %v -> src remote %v] copying...", dstRemoteAddr, dstLocalAddr, srcLocalAddr, srcRemoteAddr)
-			nCopy, err := p.copyRawToFragment(src, dst)
-			log.Printf("[svr] [dst remote %v -> dst local %v -> src local %v -> src remote %v, %v coppied] done: %v", dstRemoteAddr, dstLocalAddr, srcLocalAddr, srcRemoteAddr, nCopy, err)
-		}()
-		log.Printf("[svr] [src remote %v -> src local %v -> dst local %v -> dst remote %v] copying...", srcRemoteAddr, srcLocalAddr, dstLocalAddr, dstRemoteAddr)
-		nCopy, err := p.copyFragmentToRaw(dst, src)
-		log.Printf("[svr] [src remote %v -> src local %v -> dst local %v -> dst remote %v, %v coppied] done: %v", srcRemoteAddr, srcLocalAddr, dstLocalAddr, dstRemoteAddr, nCopy, err)
+		srcToDst, errSrc = p.copyFragmentToRaw(dst, src, packer, s, dirSrcToDst)
 	} else {
-		go func() {
-			defer closePipe()
-			log.Printf("[cli] [dst remote %v -> dst local %v -> src local %v -> src remote %v] copying...", dstRemoteAddr, dstLocalAddr, srcLocalAddr, srcRemoteAddr)
-			nCopy, err := p.copyFragmentToRaw(src, dst)
-			log.Printf("[cli] [dst remote %v -> dst local %v -> src local %v -> src remote %v, %v coppied] done: %v", dstRemoteAddr, dstLocalAddr, srcLocalAddr, srcRemoteAddr, nCopy, err)
-		}()
-		log.Printf("[cli] [src remote %v -> src local %v -> dst local %v -> dst remote %v] copying...", srcRemoteAddr, srcLocalAddr, dstLocalAddr, dstRemoteAddr)
-		nCopy, err := p.copyRawToFragment(dst, src)
-		log.Printf("[cli] [src remote %v -> src local %v -> dst local %v -> dst remote %v, %v coppied] done: %v", srcRemoteAddr, srcLocalAddr, dstLocalAddr, dstRemoteAddr, nCopy, err)
+		srcToDst, errSrc = p.copyRawToFragment(dst, src, packer, s, dirSrcToDst)
+	}
+	closePipe()
+	<-chDone
+
+	// the direction that stopped first closed the pipe, the other one only
+	// saw the resulting close error
+	reason := errSrc
+	if s.killed() {
+		reason = ErrSessionClosed
+	} else if errors.Is(errSrc, net.ErrClosed) && errDst != nil {
+		reason = errDst
+	}
+	stats := SessionStats{
+		Session:  session,
+		SrcToDst: srcToDst,
+		DstToSrc: dstToSrc,
+		Duration: time.Since(session.Start),
+		Err:      reason,
+	}
+	log.Info("session close", append(addrs, "src_to_dst", srcToDst, "dst_to_src", dstToSrc, "duration", stats.Duration, "err", reason)...)
+	if p.Hooks.OnSessionClose != nil {
+		p.Hooks.OnSessionClose(&stats)
 	}
 }
 
-func (p *Pipe) copyRawToFragment(dst, src net.Conn) (int64, error) {
+func (p *Pipe) copyRawToFragment(dst, src net.Conn, packer Packer, s *liveSession, dir int) (int64, error) {
 	var (
 		err       error
 		nread     int
 		ncopy     int64
 		buffer    = make([]byte, p.ReadBufferSize)
 		packet    []byte
-		srcReader = src // bufio.NewReader(src)
-		dstWriter = dst // bufio.NewWriter(dst)
+		srcReader = src.Read // bufio.NewReader(src)
+		dstWriter = dst      // bufio.NewWriter(dst)
 		pack      func([]byte) ([]byte, error)
 	)
-	if p.Packer != nil {
-		pack = p.Packer.Pack
+	if packer != nil {
+		pack = packer.Pack
+	}
+	if p.Datagram {
+		// one extra byte tells a datagram that exactly fits from one that
+		// was truncated by a plain Read
+		buffer = make([]byte, p.ReadBufferSize+1)
+		if dr, ok := src.(DatagramReader); ok {
+			srcReader = dr.ReadDatagram
+		}
 	}
 	for {
 		if p.Timeout > 0 {
 			src.SetReadDeadline(time.Now().Add(p.Timeout))
 		}
-		nread, err = srcReader.Read(buffer)
+		nread, err = srcReader(buffer)
+		if p.Datagram && (err == ErrDatagramTooLarge || (err == nil && nread > p.ReadBufferSize)) {
+			p.logger().Warn("datagram dropped", "local", src.LocalAddr().String(), "remote", src.RemoteAddr().String(), "max_size", p.ReadBufferSize)
+			continue
+		}
 		if err != nil {
 			goto Exit
 		}
 		if pack != nil {
 			packet, err = pack(buffer[:nread])
 			if err != nil {
+				p.stats.incPackErrors()
 				goto Exit
 			}
 		} else {
 			packet = buffer[:nread]
 		}
-		_, err = WriteFragment(dstWriter, packet)
+		if s.limiter != nil {
+			err = s.limiter.wait(dir, nread, s.done)
+			if err != nil {
+				goto Exit
+			}
+		}
+		_, err = WriteFragmentVersion(dstWriter, packet, p.FrameVersion, p.MaxFrameSize)
 		if err != nil {
 			goto Exit
 		}
 		ncopy += int64(nread)
+		s.addCopied(dir, nread)
 	}
 
 Exit:
 	return ncopy, err
 }
 
-func (p *Pipe) copyFragmentToRaw(dst, src net.Conn) (int64, error) {
+func (p *Pipe) copyFragmentToRaw(dst, src net.Conn, packer Packer, s *liveSession, dir int) (int64, error) {
 	var (
 		err       error
+		b         []byte
 		nread     int
 		ncopy     int64
 		srcReader = src // bufio.NewReader(src)
 		pack      func([]byte) ([]byte, error)
 	)
-	if p.Packer != nil {
-		pack = p.Packer.Unpack
+	if packer != nil {
+		pack = packer.Unpack
 	}
 	for {
 		if p.Timeout > 0 {
 			src.SetReadDeadline(time.Now().Add(p.Timeout))
 		}
-		b, err := ReadFragment(srcReader)
+		b, err = ReadFragmentVersion(srcReader, p.FrameVersion, p.MaxFrameSize)
 		if err != nil {
 			goto Exit
 		}
-		nread = len(b)
 		if pack != nil {
 			b, err = pack(b)
+			if err != nil {
+				p.stats.incUnpackErrors()
+				goto Exit
+			}
+		}
+		nread = len(b)
+		if s.limiter != nil {
+			err = s.limiter.wait(dir, nread, s.done)
 			if err != nil {
 				goto Exit
 			}
@@ -229,6 +579,7 @@ func (p *Pipe) copyFragmentToRaw(dst, src net.Conn) (int64, error) {
 			goto Exit
 		}
 		ncopy += int64(nread)
+		s.addCopied(dir, nread)
 	}
 
 Exit:
@@ -0,0 +1,112 @@
+package pipe_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lesismal/pipe"
+	"github.com/lesismal/pipe/packer"
+)
+
+func startHandshakeServer(t *testing.T, psk []byte, dials *int32) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pipe.Pipe{
+		Listen: func() (net.Listener, error) { return ln, nil },
+		Dial: func(net.Conn) (net.Conn, error) {
+			atomic.AddInt32(dials, 1)
+			a, b := net.Pipe()
+			go b.Close()
+			return a, nil
+		},
+		Handshake: &packer.Handshake{PSK: psk},
+		Timeout:   5 * time.Second,
+	}
+	if err := p.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		p.Shutdown(ctx)
+	})
+	return ln.Addr().String()
+}
+
+func clientHandshake(t *testing.T, addr string, psk []byte) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = (&packer.Handshake{PSK: psk}).Handshake(conn, false)
+	return err
+}
+
+func waitDials(dials *int32, want int32) int32 {
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(dials) != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return atomic.LoadInt32(dials)
+}
+
+func TestServerHandshakeBeforeDial(t *testing.T) {
+	psk := bytes.Repeat([]byte{1}, 32)
+	wrong := bytes.Repeat([]byte{2}, 32)
+
+	var dials int32
+	addr := startHandshakeServer(t, psk, &dials)
+
+	if err := clientHandshake(t, addr, wrong); err == nil {
+		t.Fatal("handshake with a wrong PSK succeeded")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 0 {
+		t.Fatalf("server dialed %v times for a client with a wrong PSK", n)
+	}
+
+	if err := clientHandshake(t, addr, psk); err != nil {
+		t.Fatalf("handshake with the right PSK failed: %v", err)
+	}
+	if n := waitDials(&dials, 1); n != 1 {
+		t.Fatalf("server dialed %v times for an authenticated client, want 1", n)
+	}
+}
+
+func TestAdminHandlerErrors(t *testing.T) {
+	p := &pipe.Pipe{}
+	tests := []struct {
+		method, target string
+		code           int
+		body           string
+	}{
+		{http.MethodDelete, "/?id=x", http.StatusBadRequest, `{"error":"invalid id"}`},
+		{http.MethodDelete, "/?id=7", http.StatusNotFound, `{"error":"session not found"}`},
+		{http.MethodDelete, "/", http.StatusBadRequest, `{"error":"id or src required"}`},
+		{http.MethodPost, "/", http.StatusMethodNotAllowed, `{"error":"method not allowed"}`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != tt.code {
+			t.Fatalf("%v %v: got status %v, want %v", tt.method, tt.target, w.Code, tt.code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%v %v: got Content-Type %q", tt.method, tt.target, ct)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != tt.body {
+			t.Fatalf("%v %v: got body %v, want %v", tt.method, tt.target, body, tt.body)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lesismal/pipe"
+)
+
+var ErrNoUpstream = errors.New("balancer: no upstream available")
+
+const (
+	// BalanceRoundRobin takes the upstreams in turn.
+	BalanceRoundRobin = iota
+	// BalanceLeastConn prefers the upstream with the fewest open conns
+	// relative to its weight.
+	BalanceLeastConn
+	// BalanceRandom picks upstreams at random in proportion to their weight.
+	BalanceRandom
+	// BalanceSourceHash maps each source IP to the same upstream with a
+	// consistent hash ring, so adding or removing an upstream only moves the
+	// sources of that upstream.
+	BalanceSourceHash
+)
+
+// Upstream is one destination of a Balancer, Dial can be any dialer such as
+// DialTCP or DialWebsocket. Name identifies it on the hash ring and defaults
+// to its position, Weight defaults to 1. Check is the probe run by the
+// Balancer's HealthCheck, such as TCPCheck or HandshakeCheck.
+type Upstream struct {
+	Name   string
+	Dial   func(net.Conn) (net.Conn, error)
+	Weight int
+	Check  func() error
+
+	active int64
+	health upstreamHealth
+}
+
+func (u *Upstream) ActiveConns() int64 {
+	return atomic.LoadInt64(&u.active)
+}
+
+// Balancer dials one of its upstreams per conn and fails over to the next
+// candidate of the strategy when a dial fails, trying at most MaxAttempts
+// upstreams (default all). Upstreams marked down by Health are tried last. Use
+// its Dial as Pipe.Dial. Upstreams must not be changed after the first Dial.
+type Balancer struct {
+	Upstreams   []*Upstream
+	Strategy    int
+	MaxAttempts int
+	Health      *HealthCheck
+
+	once    sync.Once
+	closed  int32
+	chClose chan struct{}
+	next    uint64
+	mux     sync.Mutex
+	random  *rand.Rand
+	ring    []ringNode
+}
+
+type ringNode struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+const ringReplicas = 64
+
+func (b *Balancer) init() {
+	b.once.Do(func() {
+		b.random = rand.New(rand.NewSource(rand.Int63()))
+		for i, u := range b.Upstreams {
+			if u.Name == "" {
+				u.Name = strconv.Itoa(i)
+			}
+			if u.Weight <= 0 {
+				u.Weight = 1
+			}
+			for r := 0; r < ringReplicas*u.Weight; r++ {
+				b.ring = append(b.ring, ringNode{hash: hash32(u.Name + "#" + strconv.Itoa(r)), upstream: u})
+			}
+		}
+		sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+		b.chClose = make(chan struct{})
+		if b.Health != nil {
+			b.Health.init()
+			go b.checkLoop()
+		}
+	})
+}
+
+// Start begins the health checks, otherwise they start with the first Dial.
+func (b *Balancer) Start() {
+	b.init()
+}
+
+func (b *Balancer) Dial(src net.Conn) (net.Conn, error) {
+	b.init()
+	// upstreams marked down are only tried after all the healthy ones failed
+	var healthy, down []*Upstream
+	for _, u := range b.candidates(src) {
+		if u.Healthy() {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	candidates := append(healthy, down...)
+	if b.MaxAttempts > 0 && len(candidates) > b.MaxAttempts {
+		candidates = candidates[:b.MaxAttempts]
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoUpstream
+	}
+
+	var errs []error
+	for _, u := range candidates {
+		atomic.AddInt64(&u.active, 1)
+		conn, err := u.Dial(src)
+		if err != nil {
+			b.report(u, err)
+			atomic.AddInt64(&u.active, -1)
+			errs = append(errs, fmt.Errorf("upstream %v: %w", u.Name, err))
+			continue
+		}
+		b.report(u, nil)
+		return wrapUpstreamConn(conn, u), nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// candidates returns the upstreams in the order they should be tried.
+func (b *Balancer) candidates(src net.Conn) []*Upstream {
+	n := len(b.Upstreams)
+	list := make([]*Upstream, 0, n)
+	switch b.Strategy {
+	case BalanceLeastConn:
+		start := int(atomic.AddUint64(&b.next, 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			list = append(list, b.Upstreams[(start+i)%n])
+		}
+		sort.SliceStable(list, func(i, j int) bool {
+			// compare active/weight without dividing
+			return list[i].ActiveConns()*int64(list[j].Weight) < list[j].ActiveConns()*int64(list[i].Weight)
+		})
+	case BalanceRandom:
+		rest := append([]*Upstream{}, b.Upstreams...)
+		total := 0
+		for _, u := range rest {
+			total += u.Weight
+		}
+		b.mux.Lock()
+		for len(rest) > 0 {
+			r := b.random.Intn(total)
+			i := 0
+			for ; r >= rest[i].Weight; i++ {
+				r -= rest[i].Weight
+			}
+			list = append(list, rest[i])
+			total -= rest[i].Weight
+			rest = append(rest[:i], rest[i+1:]...)
+		}
+		b.mux.Unlock()
+	case BalanceSourceHash:
+		var key string
+		if src != nil {
+			key = hostOf(src.RemoteAddr())
+		}
+		h := hash32(key)
+		start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+		seen := map[*Upstream]bool{}
+		for i := 0; i < len(b.ring) && len(list) < n; i++ {
+			u := b.ring[(start+i)%len(b.ring)].upstream
+			if !seen[u] {
+				seen[u] = true
+				list = append(list, u)
+			}
+		}
+	default:
+		start := int(atomic.AddUint64(&b.next, 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			list = append(list, b.Upstreams[(start+i)%n])
+		}
+	}
+	return list
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// upstreamConn releases its upstream's active count on Close.
+type upstreamConn struct {
+	net.Conn
+	upstream *Upstream
+	closed   int32
+}
+
+func (c *upstreamConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.upstream.active, -1)
+	}
+	return c.Conn.Close()
+}
+
+// upstreamDatagramConn keeps pipe.DatagramReader visible through the wrapper.
+type upstreamDatagramConn struct {
+	*upstreamConn
+	dr pipe.DatagramReader
+}
+
+func (c *upstreamDatagramConn) ReadDatagram(b []byte) (int, error) {
+	return c.dr.ReadDatagram(b)
+}
+
+func wrapUpstreamConn(conn net.Conn, u *Upstream) net.Conn {
+	c := &upstreamConn{Conn: conn, upstream: u}
+	if dr, ok := conn.(pipe.DatagramReader); ok {
+		return &upstreamDatagramConn{upstreamConn: c, dr: dr}
+	}
+	return c
+}
@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/lesismal/pipe"
+)
+
+// HealthCheck runs every Upstream's Check each Interval. An upstream is
+// marked down after Fall consecutive failures and up again after Rise
+// consecutive successes, dials count as probes too. Upstreams start up, and
+// ones without a Check are always up. Down upstreams are still dialed as a
+// last resort when every healthy one has failed.
+type HealthCheck struct {
+	Interval time.Duration
+	Rise     int
+	Fall     int
+	OnChange func(u *Upstream, up bool)
+}
+
+func (hc *HealthCheck) init() {
+	if hc.Interval <= 0 {
+		hc.Interval = 5 * time.Second
+	}
+	if hc.Rise <= 0 {
+		hc.Rise = 2
+	}
+	if hc.Fall <= 0 {
+		hc.Fall = 3
+	}
+}
+
+type upstreamHealth struct {
+	down      int32
+	successes int32
+	failures  int32
+}
+
+func (u *Upstream) Healthy() bool {
+	return atomic.LoadInt32(&u.health.down) == 0
+}
+
+// report records one probe or dial result, it is only called from the
+// balancer's check loop and Dial, the counters are reset on every flip.
+func (b *Balancer) report(u *Upstream, err error) {
+	hc := b.Health
+	if hc == nil || u.Check == nil {
+		return
+	}
+	h := &u.health
+	if err == nil {
+		atomic.StoreInt32(&h.failures, 0)
+		if atomic.AddInt32(&h.successes, 1) >= int32(hc.Rise) && atomic.CompareAndSwapInt32(&h.down, 1, 0) {
+			if hc.OnChange != nil {
+				hc.OnChange(u, true)
+			}
+		}
+		return
+	}
+	atomic.StoreInt32(&h.successes, 0)
+	if atomic.AddInt32(&h.failures, 1) >= int32(hc.Fall) && atomic.CompareAndSwapInt32(&h.down, 0, 1) {
+		if hc.OnChange != nil {
+			hc.OnChange(u, false)
+		}
+	}
+}
+
+func (b *Balancer) checkLoop() {
+	ticker := time.NewTicker(b.Health.Interval)
+	defer ticker.Stop()
+	for {
+		b.checkAll()
+		select {
+		case <-ticker.C:
+		case <-b.chClose:
+			return
+		}
+	}
+}
+
+func (b *Balancer) checkAll() {
+	done := make(chan struct{}, len(b.Upstreams))
+	for _, u := range b.Upstreams {
+		if u.Check == nil {
+			done <- struct{}{}
+			continue
+		}
+		go func(u *Upstream) {
+			defer func() { done <- struct{}{} }()
+			defer pipe.Recover()
+			b.report(u, u.Check())
+		}(u)
+	}
+	for range b.Upstreams {
+		<-done
+	}
+}
+
+// Close stops the health checks.
+func (b *Balancer) Close() error {
+	b.init()
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		close(b.chClose)
+	}
+	return nil
+}
+
+// TCPCheck succeeds if a TCP connection to addr opens within timeout.
+func TCPCheck(addr string, timeout time.Duration) func() error {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// WebsocketCheck succeeds if the websocket handshake with a pipe server
+// listening with ListenWebsocketWithOptions completes within timeout.
+func WebsocketCheck(addr string, opts *WebsocketOptions, timeout time.Duration) func() error {
+	var o WebsocketOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.HandshakeTimeout = timeout
+	dial := DialWebsocketWithOptions(addr, &o)
+	return func() error {
+		conn, err := dial(nil)
+		if err != nil {
+			return err
+		}
+		if wc, ok := conn.(interface {
+			WriteControl(messageType int, data []byte, deadline time.Time) error
+		}); ok {
+			wc.WriteControl(gorilla.CloseMessage, gorilla.FormatCloseMessage(gorilla.CloseNormalClosure, ""), time.Now().Add(timeout))
+		}
+		return conn.Close()
+	}
+}
+
+// HandshakeCheck dials an upstream pipe server and runs the client side of
+// handshaker, the same key exchange a session does before any payload goes
+// through the packer, so it fails on a wrong key as well as on a dead server.
+// The server dials its destination only once the handshake has succeeded, so
+// a probe with a wrong key never reaches the destination.
+func HandshakeCheck(dial func(net.Conn) (net.Conn, error), handshaker pipe.Handshaker, timeout time.Duration) func() error {
+	return func() error {
+		conn, err := dial(nil)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(timeout))
+		_, err = handshaker.Handshake(conn, false)
+		return err
+	}
+}
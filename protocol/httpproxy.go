@@ -0,0 +1,271 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/pipe"
+)
+
+var (
+	ErrHTTPProxyAuth    = errors.New("http proxy: authentication failed")
+	ErrHTTPProxyRequest = errors.New("http proxy: invalid request")
+)
+
+type HTTPProxyOptions struct {
+	Username string
+	Password string
+	Timeout  time.Duration
+	Logger   pipe.Logger
+}
+
+type HTTPProxyListener struct {
+	ln       net.Listener
+	opts     HTTPProxyOptions
+	ch       chan net.Conn
+	chClosed chan struct{}
+	closed   int32
+}
+
+func (ln *HTTPProxyListener) accept() {
+	for {
+		conn, err := ln.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			ln.Close()
+			return
+		}
+		go ln.handshake(conn)
+	}
+}
+
+func (ln *HTTPProxyListener) handshake(conn net.Conn) {
+	defer pipe.RecoverTo(loggerOf(ln.opts.Logger))
+
+	timeout := ln.opts.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := ln.readRequest(conn)
+	if err != nil {
+		loggerOf(ln.opts.Logger).Warn("http proxy handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case ln.ch <- c:
+	case <-ln.chClosed:
+		c.Close()
+	}
+}
+
+func (ln *HTTPProxyListener) readRequest(conn net.Conn) (*HTTPProxyConn, error) {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ln.authorized(req) {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"pipe\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return nil, ErrHTTPProxyAuth
+	}
+
+	c := &HTTPProxyConn{Conn: conn, reader: reader}
+	if req.Method == http.MethodConnect {
+		c.isConnect = true
+		c.dstAddr = hostPort(req.Host, "443")
+		return c, nil
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return nil, ErrHTTPProxyRequest
+	}
+	c.dstAddr = hostPort(req.URL.Host, "80")
+
+	// forward the request in origin-form, the body still streams from reader
+	for _, v := range req.Header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			req.Header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Set("Connection", "close")
+	// ReadRequest moves Transfer-Encoding out of the header, the body is
+	// forwarded as it came so the header has to go with it
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s HTTP/%d.%d\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.ProtoMajor, req.ProtoMinor, req.Host)
+	req.Header.Write(&head)
+	head.WriteString("\r\n")
+	c.pending = head.Bytes()
+	return c, nil
+}
+
+func (ln *HTTPProxyListener) authorized(req *http.Request) bool {
+	if ln.opts.Username == "" && ln.opts.Password == "" {
+		return true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return false
+	}
+	username, password, _ := strings.Cut(string(b), ":")
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(ln.opts.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(ln.opts.Password)) == 1
+	return userOK && passOK
+}
+
+func (ln *HTTPProxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.ch:
+		return c, nil
+	case <-ln.chClosed:
+		return nil, io.EOF
+	}
+}
+
+func (ln *HTTPProxyListener) Close() error {
+	if atomic.CompareAndSwapInt32(&ln.closed, 0, 1) {
+		close(ln.chClosed)
+		return ln.ln.Close()
+	}
+	return nil
+}
+
+func (ln *HTTPProxyListener) Addr() net.Addr {
+	return ln.ln.Addr()
+}
+
+// ListenHTTPProxy accepts HTTP proxy clients, both CONNECT tunnels and plain
+// requests with an absolute URI. Every accepted conn is a DstConn, use it
+// with WithWritingConnDstAddr to let the remote pipe dial the target host.
+func ListenHTTPProxy(addr string, opts *HTTPProxyOptions) func() (net.Listener, error) {
+	return func() (net.Listener, error) {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		ln := &HTTPProxyListener{
+			ln:       l,
+			ch:       make(chan net.Conn, 1024),
+			chClosed: make(chan struct{}),
+		}
+		if opts != nil {
+			ln.opts = *opts
+		}
+		go ln.accept()
+		return ln, nil
+	}
+}
+
+// HTTPProxyConn is one proxied request. For CONNECT the 200 response is sent
+// on the first Read or Write after the pipe has dialed, or a 502 if it is
+// closed before. For plain requests Read returns the rewritten request first.
+type HTTPProxyConn struct {
+	net.Conn
+
+	mux       sync.Mutex
+	reader    *bufio.Reader
+	dstAddr   string
+	isConnect bool
+	pending   []byte
+	replied   bool
+}
+
+func (c *HTTPProxyConn) DstNetwork() string {
+	return "tcp"
+}
+
+func (c *HTTPProxyConn) DstAddr() string {
+	return c.dstAddr
+}
+
+func (c *HTTPProxyConn) reply(status string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.replied {
+		return nil
+	}
+	c.replied = true
+	if !c.isConnect && status == "200 Connection established" {
+		return nil
+	}
+	_, err := io.WriteString(c.Conn, "HTTP/1.1 "+status+"\r\n\r\n")
+	return err
+}
+
+// NetConn returns the client's TCP connection.
+func (c *HTTPProxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *HTTPProxyConn) Read(b []byte) (int, error) {
+	err := c.reply("200 Connection established")
+	if err != nil {
+		return 0, err
+	}
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.reader.Read(b)
+}
+
+func (c *HTTPProxyConn) Write(b []byte) (int, error) {
+	err := c.reply("200 Connection established")
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *HTTPProxyConn) Close() error {
+	c.reply("502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close")
+	return c.Conn.Close()
+}
+
+// hopHeaders apply to the client's connection to the proxy only.
+var hopHeaders = []string{
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Upgrade",
+}
+
+func hostPort(host, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
@@ -1,11 +1,24 @@
 package protocol
 
 import (
+	"errors"
+	"log/slog"
 	"net"
+	"strings"
 
 	"github.com/lesismal/pipe"
 )
 
+var ErrNoDstAddr = errors.New("src conn has no destination address")
+
+// loggerOf returns l, or slog.Default() like a Pipe without a Logger.
+func loggerOf(l pipe.Logger) pipe.Logger {
+	if l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
 func WithReadingDstAddr(dialer func(string) func(net.Conn) (net.Conn, error)) func(net.Conn) (net.Conn, error) {
 	return func(src net.Conn) (net.Conn, error) {
 		b, err := pipe.ReadFragment(src)
@@ -32,3 +45,32 @@ func WithWritingDstAddr(proxyAddr, serverAddr string, dialer func(string) func(n
 		return dst, err
 	}
 }
+
+// WithWritingConnDstAddr is like WithWritingDstAddr, but sends the
+// destination chosen by the client of each DstConn, such as the conns
+// accepted from ListenSOCKS5. UDP destinations are sent as "udp://host:port",
+// which DialAddr understands on the remote pipe.
+func WithWritingConnDstAddr(proxyAddr string, dialer func(string) func(net.Conn) (net.Conn, error)) func(net.Conn) (net.Conn, error) {
+	return func(src net.Conn) (net.Conn, error) {
+		dc, ok := src.(DstConn)
+		if !ok {
+			return nil, ErrNoDstAddr
+		}
+		serverAddr := dc.DstAddr()
+		if dc.DstNetwork() == "udp" {
+			serverAddr = "udp://" + serverAddr
+		}
+		return WithWritingDstAddr(proxyAddr, serverAddr, dialer)(src)
+	}
+}
+
+// DialAddr dials "udp://host:port" with DialUDP and "tcp://host:port" or
+// "host:port" with DialTCP, to be used with WithReadingDstAddr.
+func DialAddr(addr string) func(net.Conn) (net.Conn, error) {
+	switch {
+	case strings.HasPrefix(addr, "udp://"):
+		return DialUDP(strings.TrimPrefix(addr, "udp://"))
+	default:
+		return DialTCP(strings.TrimPrefix(addr, "tcp://"))
+	}
+}
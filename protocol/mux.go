@@ -0,0 +1,733 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/pipe"
+)
+
+// Every mux frame is sent as one fragment on the transport connection:
+//
+//	type(1) | stream id(4, little endian) | payload
+//
+// muxOpen has no payload, muxData carries stream data, muxClose closes both
+// directions of the stream, muxWindow carries a 4-byte window increment.
+// muxPing and muxPong use stream id 0 and have no payload, a ping is
+// answered by a pong, pings that arrive while a pong is pending share it.
+const (
+	muxOpen   byte = 1
+	muxData   byte = 2
+	muxClose  byte = 3
+	muxWindow byte = 4
+	muxPing   byte = 5
+	muxPong   byte = 6
+
+	muxHeadSize       = 5
+	muxMaxPayloadSize = 32768
+	muxInitialWindow  = 256 * 1024
+	muxAcceptBacklog  = 1024
+)
+
+var (
+	ErrMuxSessionClosed = errors.New("mux session closed")
+	ErrMuxStreamClosed  = errors.New("mux stream closed")
+	ErrMuxProtocol      = errors.New("mux protocol error")
+	ErrMuxKeepAlive     = errors.New("mux keepalive timeout")
+)
+
+// MuxOptions configures a MuxSession. Every KeepAlive (default 15s) the
+// session pings its peer, and it closes with ErrMuxKeepAlive once nothing has
+// arrived for KeepAliveTimeout (default 45s), so a transport dropped silently,
+// e.g. by an expired NAT mapping, is noticed. A negative KeepAlive disables
+// both.
+type MuxOptions struct {
+	KeepAlive        time.Duration
+	KeepAliveTimeout time.Duration
+}
+
+func (o *MuxOptions) init() {
+	if o.KeepAlive == 0 {
+		o.KeepAlive = 15 * time.Second
+	}
+	if o.KeepAlive > 0 && o.KeepAliveTimeout <= 0 {
+		o.KeepAliveTimeout = 3 * o.KeepAlive
+	}
+}
+
+// MuxSession carries many MuxStreams over one transport connection. Both ends
+// can open streams, the client uses odd ids and the server even ids.
+type MuxSession struct {
+	mux  sync.Mutex
+	wmux sync.Mutex
+
+	opts        MuxOptions
+	lastRecv    int64
+	pongPending int32
+	conn        net.Conn
+	streams     map[uint32]*MuxStream
+	nextID      uint32
+	chAccept    chan *MuxStream
+	chClosed    chan struct{}
+	closed      int32
+	draining    bool
+	err         error
+}
+
+func NewMuxSession(conn net.Conn, isClient bool) *MuxSession {
+	return NewMuxSessionWithOptions(conn, isClient, nil)
+}
+
+func NewMuxSessionWithOptions(conn net.Conn, isClient bool, opts *MuxOptions) *MuxSession {
+	s := &MuxSession{
+		conn:     conn,
+		lastRecv: time.Now().UnixNano(),
+		streams:  map[uint32]*MuxStream{},
+		nextID:   2,
+		chAccept: make(chan *MuxStream, muxAcceptBacklog),
+		chClosed: make(chan struct{}),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	s.opts.init()
+	if isClient {
+		s.nextID = 1
+	}
+	go s.readLoop()
+	if s.opts.KeepAlive > 0 {
+		go s.keepAlive()
+	}
+	return s
+}
+
+func (s *MuxSession) Open() (net.Conn, error) {
+	s.mux.Lock()
+	if s.IsClosed() || s.draining {
+		s.mux.Unlock()
+		return nil, ErrMuxSessionClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newMuxStream(s, id)
+	s.streams[id] = stream
+	s.mux.Unlock()
+
+	err := s.writeFrame(muxOpen, id, nil)
+	if err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *MuxSession) Accept() (net.Conn, error) {
+	select {
+	case stream := <-s.chAccept:
+		return stream, nil
+	case <-s.chClosed:
+		return nil, s.closeErr()
+	}
+}
+
+func (s *MuxSession) Close() error {
+	return s.closeWithError(ErrMuxSessionClosed)
+}
+
+func (s *MuxSession) IsClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+func (s *MuxSession) Done() <-chan struct{} {
+	return s.chClosed
+}
+
+func (s *MuxSession) NumStreams() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.streams)
+}
+
+func (s *MuxSession) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *MuxSession) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *MuxSession) closeErr() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.err
+}
+
+func (s *MuxSession) closeWithError(err error) error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+	s.mux.Lock()
+	s.err = err
+	streams := s.streams
+	s.streams = map[uint32]*MuxStream{}
+	s.mux.Unlock()
+
+	close(s.chClosed)
+	for _, stream := range streams {
+		stream.remoteClose()
+	}
+	return s.conn.Close()
+}
+
+// CloseWhenIdle refuses new streams and closes the session once the streams
+// still open are all closed.
+func (s *MuxSession) CloseWhenIdle() {
+	s.mux.Lock()
+	s.draining = true
+	idle := len(s.streams) == 0
+	s.mux.Unlock()
+	if idle {
+		s.Close()
+	}
+}
+
+func (s *MuxSession) removeStream(id uint32) {
+	s.mux.Lock()
+	delete(s.streams, id)
+	idle := s.draining && len(s.streams) == 0
+	s.mux.Unlock()
+	if idle {
+		go s.Close()
+	}
+}
+
+func (s *MuxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeadSize+len(payload))
+	frame[0] = typ
+	binary.LittleEndian.PutUint32(frame[1:], id)
+	copy(frame[muxHeadSize:], payload)
+
+	s.wmux.Lock()
+	defer s.wmux.Unlock()
+	if s.IsClosed() {
+		return ErrMuxSessionClosed
+	}
+	_, err := pipe.WriteFragment(s.conn, frame)
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
+
+func (s *MuxSession) keepAlive() {
+	defer pipe.Recover()
+	ticker := time.NewTicker(s.opts.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.chClosed:
+			return
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv))) > s.opts.KeepAliveTimeout {
+			s.closeWithError(ErrMuxKeepAlive)
+			return
+		}
+		// a write stuck on a dead transport is released by the timeout above
+		go s.writeFrame(muxPing, 0, nil)
+	}
+}
+
+func (s *MuxSession) writePong() {
+	defer atomic.StoreInt32(&s.pongPending, 0)
+	s.writeFrame(muxPong, 0, nil)
+}
+
+func (s *MuxSession) readLoop() {
+	defer pipe.Recover()
+	for {
+		frame, err := pipe.ReadFragment(s.conn)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		if len(frame) < muxHeadSize {
+			s.closeWithError(ErrMuxProtocol)
+			return
+		}
+		typ, id, payload := frame[0], binary.LittleEndian.Uint32(frame[1:]), frame[muxHeadSize:]
+
+		s.mux.Lock()
+		stream := s.streams[id]
+		s.mux.Unlock()
+
+		switch typ {
+		case muxPing:
+			// a single writer per session, so a ping flood can't pile up
+			// goroutines waiting for the write lock
+			if atomic.CompareAndSwapInt32(&s.pongPending, 0, 1) {
+				go s.writePong()
+			}
+		case muxPong:
+		case muxOpen:
+			if stream != nil {
+				s.closeWithError(ErrMuxProtocol)
+				return
+			}
+			stream = newMuxStream(s, id)
+			s.mux.Lock()
+			draining := s.draining
+			s.streams[id] = stream
+			s.mux.Unlock()
+			if draining {
+				stream.Close()
+				continue
+			}
+			select {
+			case s.chAccept <- stream:
+			default:
+				stream.Close()
+			}
+		case muxData:
+			if stream == nil {
+				continue
+			}
+			if !stream.push(payload) {
+				s.closeWithError(ErrMuxProtocol)
+				return
+			}
+		case muxClose:
+			if stream == nil {
+				continue
+			}
+			s.removeStream(id)
+			stream.remoteClose()
+		case muxWindow:
+			if stream == nil {
+				continue
+			}
+			if len(payload) != 4 {
+				s.closeWithError(ErrMuxProtocol)
+				return
+			}
+			stream.addSendWindow(binary.LittleEndian.Uint32(payload))
+		default:
+			s.closeWithError(ErrMuxProtocol)
+			return
+		}
+	}
+}
+
+// MuxStream is a logical connection carried by a MuxSession.
+type MuxStream struct {
+	mux sync.Mutex
+
+	id      uint32
+	session *MuxSession
+
+	buffer       []byte
+	recvWindow   int
+	recvConsumed int
+	sendWindow   int
+	chRead       chan struct{}
+	chWindow     chan struct{}
+
+	closed       bool
+	remoteClosed bool
+	chClosed     chan struct{}
+
+	rDeadline time.Time
+	wDeadline time.Time
+}
+
+func newMuxStream(session *MuxSession, id uint32) *MuxStream {
+	return &MuxStream{
+		id:         id,
+		session:    session,
+		recvWindow: muxInitialWindow,
+		sendWindow: muxInitialWindow,
+		chRead:     make(chan struct{}, 1),
+		chWindow:   make(chan struct{}, 1),
+		chClosed:   make(chan struct{}),
+	}
+}
+
+func (stream *MuxStream) push(b []byte) bool {
+	stream.mux.Lock()
+	defer stream.mux.Unlock()
+	if len(stream.buffer)+len(b) > stream.recvWindow {
+		return false
+	}
+	if stream.closed {
+		return true
+	}
+	stream.buffer = append(stream.buffer, b...)
+	notify(stream.chRead)
+	return true
+}
+
+func (stream *MuxStream) addSendWindow(n uint32) {
+	stream.mux.Lock()
+	stream.sendWindow += int(n)
+	stream.mux.Unlock()
+	notify(stream.chWindow)
+}
+
+func (stream *MuxStream) remoteClose() {
+	stream.mux.Lock()
+	stream.remoteClosed = true
+	stream.mux.Unlock()
+	notify(stream.chRead)
+	notify(stream.chWindow)
+}
+
+func (stream *MuxStream) Read(b []byte) (int, error) {
+	for {
+		stream.mux.Lock()
+		if stream.closed {
+			stream.mux.Unlock()
+			return 0, ErrMuxStreamClosed
+		}
+		if len(stream.buffer) > 0 {
+			n := copy(b, stream.buffer)
+			stream.buffer = stream.buffer[n:]
+			if len(stream.buffer) == 0 {
+				stream.buffer = nil
+			}
+			stream.recvConsumed += n
+			var increment int
+			if stream.recvConsumed >= stream.recvWindow/2 && !stream.remoteClosed {
+				increment = stream.recvConsumed
+				stream.recvConsumed = 0
+			}
+			stream.mux.Unlock()
+			if increment > 0 {
+				payload := make([]byte, 4)
+				binary.LittleEndian.PutUint32(payload, uint32(increment))
+				stream.session.writeFrame(muxWindow, stream.id, payload)
+			}
+			return n, nil
+		}
+		if stream.remoteClosed {
+			stream.mux.Unlock()
+			return 0, io.EOF
+		}
+		deadline := stream.rDeadline
+		stream.mux.Unlock()
+
+		err := wait(stream.chRead, stream.chClosed, deadline)
+		if err == errWaitClosed {
+			return 0, ErrMuxStreamClosed
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (stream *MuxStream) Write(b []byte) (int, error) {
+	var nTotal int
+	for len(b) > 0 {
+		stream.mux.Lock()
+		if stream.closed {
+			stream.mux.Unlock()
+			return nTotal, ErrMuxStreamClosed
+		}
+		if stream.remoteClosed {
+			stream.mux.Unlock()
+			return nTotal, io.ErrClosedPipe
+		}
+		if stream.sendWindow <= 0 {
+			deadline := stream.wDeadline
+			stream.mux.Unlock()
+			err := wait(stream.chWindow, stream.chClosed, deadline)
+			if err == errWaitClosed {
+				return nTotal, ErrMuxStreamClosed
+			}
+			if err != nil {
+				return nTotal, err
+			}
+			continue
+		}
+		n := len(b)
+		if n > muxMaxPayloadSize {
+			n = muxMaxPayloadSize
+		}
+		if n > stream.sendWindow {
+			n = stream.sendWindow
+		}
+		stream.sendWindow -= n
+		stream.mux.Unlock()
+
+		err := stream.session.writeFrame(muxData, stream.id, b[:n])
+		if err != nil {
+			return nTotal, err
+		}
+		nTotal += n
+		b = b[n:]
+	}
+	return nTotal, nil
+}
+
+func (stream *MuxStream) Close() error {
+	stream.mux.Lock()
+	if stream.closed {
+		stream.mux.Unlock()
+		return nil
+	}
+	stream.closed = true
+	stream.buffer = nil
+	remoteClosed := stream.remoteClosed
+	stream.mux.Unlock()
+	close(stream.chClosed)
+
+	stream.session.removeStream(stream.id)
+	if !remoteClosed {
+		return stream.session.writeFrame(muxClose, stream.id, nil)
+	}
+	return nil
+}
+
+func (stream *MuxStream) ID() uint32 {
+	return stream.id
+}
+
+func (stream *MuxStream) Done() <-chan struct{} {
+	return stream.chClosed
+}
+
+func (stream *MuxStream) LocalAddr() net.Addr {
+	return stream.session.LocalAddr()
+}
+
+func (stream *MuxStream) RemoteAddr() net.Addr {
+	return stream.session.RemoteAddr()
+}
+
+func (stream *MuxStream) SetDeadline(t time.Time) error {
+	stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+func (stream *MuxStream) SetReadDeadline(t time.Time) error {
+	stream.mux.Lock()
+	stream.rDeadline = t
+	stream.mux.Unlock()
+	notify(stream.chRead)
+	return nil
+}
+
+func (stream *MuxStream) SetWriteDeadline(t time.Time) error {
+	stream.mux.Lock()
+	stream.wDeadline = t
+	stream.mux.Unlock()
+	notify(stream.chWindow)
+	return nil
+}
+
+type muxDialer struct {
+	mux sync.Mutex
+
+	dialer   func(net.Conn) (net.Conn, error)
+	poolSize int
+	sessions []*MuxSession
+	next     int
+	dialing  int
+	chDialed chan struct{}
+}
+
+func (d *muxDialer) dial(src net.Conn) (net.Conn, error) {
+	for i := 0; i < 2; i++ {
+		session, err := d.session(src)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := session.Open()
+		if err == nil {
+			return stream, nil
+		}
+	}
+	return nil, ErrMuxSessionClosed
+}
+
+// session returns a live session, dialing a new transport connection while
+// the pool is not full and picking them in turn afterwards. The dial runs
+// without the lock, so streams keep going to the live sessions meanwhile,
+// only callers finding no live session wait for it.
+func (d *muxDialer) session(src net.Conn) (*MuxSession, error) {
+	d.mux.Lock()
+	for {
+		alive := d.sessions[:0]
+		for _, session := range d.sessions {
+			if !session.IsClosed() {
+				alive = append(alive, session)
+			}
+		}
+		for i := len(alive); i < len(d.sessions); i++ {
+			d.sessions[i] = nil
+		}
+		d.sessions = alive
+
+		if len(d.sessions)+d.dialing < d.poolSize {
+			break
+		}
+		if len(d.sessions) > 0 {
+			d.next = (d.next + 1) % len(d.sessions)
+			session := d.sessions[d.next]
+			d.mux.Unlock()
+			return session, nil
+		}
+		chDialed := d.chDialed
+		d.mux.Unlock()
+		<-chDialed
+		d.mux.Lock()
+	}
+
+	if d.chDialed == nil {
+		d.chDialed = make(chan struct{})
+	}
+	d.dialing++
+	d.mux.Unlock()
+
+	conn, err := d.dialer(src)
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.dialing--
+	close(d.chDialed)
+	d.chDialed = make(chan struct{})
+	if err == nil {
+		session := NewMuxSession(conn, true)
+		d.sessions = append(d.sessions, session)
+		return session, nil
+	}
+	if len(d.sessions) == 0 {
+		return nil, err
+	}
+	d.next = (d.next + 1) % len(d.sessions)
+	return d.sessions[d.next], nil
+}
+
+// DialMux opens a stream over a pool of up to poolSize long-lived transport
+// connections created by dialer, instead of dialing for every connection. The
+// remote pipe must listen with ListenMux.
+func DialMux(dialer func(net.Conn) (net.Conn, error), poolSize int) func(net.Conn) (net.Conn, error) {
+	if poolSize <= 0 {
+		poolSize = 1
+	}
+	d := &muxDialer{dialer: dialer, poolSize: poolSize}
+	return d.dial
+}
+
+type MuxListener struct {
+	mux sync.Mutex
+
+	ln       net.Listener
+	sessions map[*MuxSession]struct{}
+	ch       chan net.Conn
+	chClosed chan struct{}
+	closed   int32
+}
+
+func (ln *MuxListener) accept() {
+	defer pipe.Recover()
+	for {
+		conn, err := ln.ln.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&ln.closed) == 1 {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			ln.Close()
+			return
+		}
+		session := NewMuxSession(conn, false)
+		ln.mux.Lock()
+		if atomic.LoadInt32(&ln.closed) == 1 {
+			ln.mux.Unlock()
+			session.CloseWhenIdle()
+			return
+		}
+		ln.sessions[session] = struct{}{}
+		ln.mux.Unlock()
+		go ln.acceptStreams(session)
+	}
+}
+
+func (ln *MuxListener) acceptStreams(session *MuxSession) {
+	defer func() {
+		ln.mux.Lock()
+		delete(ln.sessions, session)
+		ln.mux.Unlock()
+	}()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case ln.ch <- stream:
+		case <-ln.chClosed:
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (ln *MuxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.ch:
+		return c, nil
+	case <-ln.chClosed:
+		return nil, io.EOF
+	}
+}
+
+// Close stops accepting, sessions are closed once their streams are closed.
+func (ln *MuxListener) Close() error {
+	if !atomic.CompareAndSwapInt32(&ln.closed, 0, 1) {
+		return nil
+	}
+	close(ln.chClosed)
+	err := ln.ln.Close()
+
+	ln.mux.Lock()
+	sessions := ln.sessions
+	ln.sessions = map[*MuxSession]struct{}{}
+	ln.mux.Unlock()
+	for session := range sessions {
+		session.CloseWhenIdle()
+	}
+	return err
+}
+
+func (ln *MuxListener) Addr() net.Addr {
+	return ln.ln.Addr()
+}
+
+// ListenMux accepts transport connections with listen and returns a listener
+// of the streams opened on them by DialMux.
+func ListenMux(listen func() (net.Listener, error)) func() (net.Listener, error) {
+	return func() (net.Listener, error) {
+		l, err := listen()
+		if err != nil {
+			return nil, err
+		}
+		ln := &MuxListener{
+			ln:       l,
+			sessions: map[*MuxSession]struct{}{},
+			ch:       make(chan net.Conn, muxAcceptBacklog),
+			chClosed: make(chan struct{}),
+		}
+		go ln.accept()
+		return ln, nil
+	}
+}
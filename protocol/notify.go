@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrTimeout is returned by the conns of this package when a deadline
+	// passes, it is a net.Error with Timeout() true.
+	ErrTimeout = timeoutError{}
+
+	// errWaitClosed is returned by wait when chClosed is closed, callers map
+	// it to their own closed error.
+	errWaitClosed = errors.New("wait: closed")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified, chClosed is closed or the deadline passes,
+// returning nil, errWaitClosed or ErrTimeout.
+func wait(ch, chClosed chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		select {
+		case <-ch:
+			return nil
+		case <-chClosed:
+			return errWaitClosed
+		}
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return ErrTimeout
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-chClosed:
+		return errWaitClosed
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
@@ -0,0 +1,332 @@
+package protocol
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lesismal/pipe"
+)
+
+var (
+	ErrDstDenied       = errors.New("destination denied by policy")
+	ErrDstSignature    = errors.New("invalid destination signature")
+	ErrDstSignatureOld = errors.New("destination signature expired or replayed")
+)
+
+// DefaultDenyCIDRs are the destinations a DstPolicy refuses unless
+// AllowPrivate is set: loopback, private, carrier-grade NAT, link-local
+// (which includes the cloud metadata endpoints), multicast, unspecified and
+// local-use NAT64 addresses. The IPv4 address embedded in a well-known NAT64
+// (64:ff9b::/96) or 6to4 (2002::/16) address is checked as well.
+var DefaultDenyCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b:1::/48",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// DstPolicy decides which destinations a pipe server using
+// WithReadingDstAddrPolicy may dial.
+//
+// AllowHosts lists host names or IP literals, "*.example.com" matches any
+// subdomain, and AllowPorts lists ports, empty lists allow any. Host names
+// are resolved once, every resolved address is checked against DenyCIDRs and
+// DefaultDenyCIDRs, and the dialer gets the checked address, so a DNS answer
+// can't change between the check and the dial. Check is called last with the
+// resolved addresses and rejects the destination by returning an error.
+//
+// If Secret is set the address header must be signed with the same secret by
+// WithWritingSignedDstAddr or WithWritingSignedConnDstAddr, signatures older
+// than MaxSkew (default one minute) or seen before are refused.
+type DstPolicy struct {
+	AllowHosts   []string
+	AllowPorts   []int
+	DenyCIDRs    []string
+	AllowPrivate bool
+	Resolver     *net.Resolver
+	Timeout      time.Duration
+	Check        func(network, host string, port int, ips []net.IP) error
+
+	Secret  []byte
+	MaxSkew time.Duration
+
+	once      sync.Once
+	initErr   error
+	deny      *pipe.ACL
+	mux       sync.Mutex
+	nonces    map[[16]byte]time.Time
+	lastClean time.Time
+}
+
+func (policy *DstPolicy) init() error {
+	policy.once.Do(func() {
+		deny := append([]string{}, policy.DenyCIDRs...)
+		if !policy.AllowPrivate {
+			deny = append(deny, DefaultDenyCIDRs...)
+		}
+		policy.deny, policy.initErr = pipe.NewACL(nil, deny)
+		if policy.Resolver == nil {
+			policy.Resolver = net.DefaultResolver
+		}
+		if policy.Timeout <= 0 {
+			policy.Timeout = 5 * time.Second
+		}
+		if policy.MaxSkew <= 0 {
+			policy.MaxSkew = time.Minute
+		}
+		policy.nonces = map[[16]byte]time.Time{}
+	})
+	return policy.initErr
+}
+
+// Resolve checks addr, "host:port" optionally prefixed by "tcp://" or
+// "udp://", and returns it with the host replaced by the checked IP.
+func (policy *DstPolicy) Resolve(addr string) (string, error) {
+	err := policy.init()
+	if err != nil {
+		return "", err
+	}
+
+	network, hostPort := "tcp", addr
+	prefix := ""
+	if i := strings.Index(addr, "://"); i >= 0 {
+		network, hostPort = addr[:i], addr[i+3:]
+		prefix = addr[:i+3]
+	}
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrDstDenied, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", fmt.Errorf("%w: invalid port %q", ErrDstDenied, portStr)
+	}
+	if !policy.portAllowed(port) {
+		return "", fmt.Errorf("%w: port %v", ErrDstDenied, port)
+	}
+	if !policy.hostAllowed(host) {
+		return "", fmt.Errorf("%w: host %v", ErrDstDenied, host)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), policy.Timeout)
+		addrs, err := policy.Resolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			return "", err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("%w: %v has no address", ErrDstDenied, host)
+	}
+	for _, ip := range ips {
+		if !policy.deny.Allowed(ip) {
+			if ip.String() == host {
+				return "", fmt.Errorf("%w: address %v", ErrDstDenied, ip)
+			}
+			return "", fmt.Errorf("%w: %v resolves to %v", ErrDstDenied, host, ip)
+		}
+		if v4 := embeddedIPv4(ip); v4 != nil && !policy.deny.Allowed(v4) {
+			return "", fmt.Errorf("%w: %v embeds %v", ErrDstDenied, ip, v4)
+		}
+	}
+	if policy.Check != nil {
+		err = policy.Check(network, host, port, ips)
+		if err != nil {
+			return "", err
+		}
+	}
+	return prefix + net.JoinHostPort(ips[0].String(), portStr), nil
+}
+
+var nat64Prefix = net.ParseIP("64:ff9b::")
+
+// embeddedIPv4 returns the IPv4 address a NAT64 or 6to4 address routes to, or
+// nil for any other address.
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
+	}
+	switch {
+	case ip[:12].Equal(nat64Prefix[:12]):
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15])
+	case ip[0] == 0x20 && ip[1] == 0x02:
+		// 6to4, 2002:aabb:ccdd::/48
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5])
+	}
+	return nil
+}
+
+func (policy *DstPolicy) portAllowed(port int) bool {
+	if len(policy.AllowPorts) == 0 {
+		return true
+	}
+	for _, p := range policy.AllowPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *DstPolicy) hostAllowed(host string) bool {
+	if len(policy.AllowHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range policy.AllowHosts {
+		h = strings.ToLower(h)
+		if h == host {
+			return true
+		}
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// signed address header: timestamp(8) | nonce(16) | hmac-sha256(32) | addr
+const dstSignatureLen = 8 + 16 + sha256.Size
+
+func signDstAddr(secret []byte, addr string) ([]byte, error) {
+	b := make([]byte, dstSignatureLen, dstSignatureLen+len(addr))
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+	_, err := rand.Read(b[8:24])
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, addr...)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(b[:24])
+	mac.Write(b[dstSignatureLen:])
+	copy(b[24:dstSignatureLen], mac.Sum(nil))
+	return b, nil
+}
+
+func (policy *DstPolicy) verify(b []byte) (string, error) {
+	if len(b) < dstSignatureLen {
+		return "", ErrDstSignature
+	}
+	mac := hmac.New(sha256.New, policy.Secret)
+	mac.Write(b[:24])
+	mac.Write(b[dstSignatureLen:])
+	if !hmac.Equal(mac.Sum(nil), b[24:dstSignatureLen]) {
+		return "", ErrDstSignature
+	}
+
+	now := time.Now()
+	ts := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if ts.Before(now.Add(-policy.MaxSkew)) || ts.After(now.Add(policy.MaxSkew)) {
+		return "", ErrDstSignatureOld
+	}
+	var nonce [16]byte
+	copy(nonce[:], b[8:24])
+	policy.mux.Lock()
+	defer policy.mux.Unlock()
+	if now.Sub(policy.lastClean) > policy.MaxSkew {
+		for k, t := range policy.nonces {
+			if now.Sub(t) > 2*policy.MaxSkew {
+				delete(policy.nonces, k)
+			}
+		}
+		policy.lastClean = now
+	}
+	if _, ok := policy.nonces[nonce]; ok {
+		return "", ErrDstSignatureOld
+	}
+	policy.nonces[nonce] = now
+	return string(b[dstSignatureLen:]), nil
+}
+
+// WithReadingDstAddrPolicy is WithReadingDstAddr with the destination checked
+// by policy before dialing.
+func WithReadingDstAddrPolicy(policy *DstPolicy, dialer func(string) func(net.Conn) (net.Conn, error)) func(net.Conn) (net.Conn, error) {
+	return func(src net.Conn) (net.Conn, error) {
+		err := policy.init()
+		if err != nil {
+			return nil, err
+		}
+		b, err := pipe.ReadFragment(src)
+		if err != nil {
+			return nil, err
+		}
+		addr := string(b)
+		if len(policy.Secret) > 0 {
+			addr, err = policy.verify(b)
+			if err != nil {
+				return nil, err
+			}
+		}
+		addr, err = policy.Resolve(addr)
+		if err != nil {
+			return nil, err
+		}
+		fDialer := dialer(addr)
+		return fDialer(src)
+	}
+}
+
+// WithWritingSignedDstAddr is WithWritingDstAddr for a server whose DstPolicy
+// has Secret set. The header is authenticated, not encrypted.
+func WithWritingSignedDstAddr(proxyAddr, serverAddr string, secret []byte, dialer func(string) func(net.Conn) (net.Conn, error)) func(net.Conn) (net.Conn, error) {
+	return func(src net.Conn) (net.Conn, error) {
+		header, err := signDstAddr(secret, serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		fDialer := dialer(proxyAddr)
+		dst, err := fDialer(src)
+		if err != nil {
+			return nil, err
+		}
+		_, err = pipe.WriteFragment(dst, header)
+		if err != nil {
+			dst.Close()
+			return nil, err
+		}
+		return dst, nil
+	}
+}
+
+// WithWritingSignedConnDstAddr is WithWritingConnDstAddr with a signed header.
+func WithWritingSignedConnDstAddr(proxyAddr string, secret []byte, dialer func(string) func(net.Conn) (net.Conn, error)) func(net.Conn) (net.Conn, error) {
+	return func(src net.Conn) (net.Conn, error) {
+		dc, ok := src.(DstConn)
+		if !ok {
+			return nil, ErrNoDstAddr
+		}
+		serverAddr := dc.DstAddr()
+		if dc.DstNetwork() == "udp" {
+			serverAddr = "udp://" + serverAddr
+		}
+		return WithWritingSignedDstAddr(proxyAddr, serverAddr, secret, dialer)(src)
+	}
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDstPolicyResolve(t *testing.T) {
+	errCheck := errors.New("check failed")
+	tests := []struct {
+		name   string
+		policy *DstPolicy
+		addr   string
+		want   string
+		err    error
+	}{
+		{"public ipv4", &DstPolicy{}, "93.184.216.34:443", "93.184.216.34:443", nil},
+		{"udp prefix", &DstPolicy{}, "udp://93.184.216.34:53", "udp://93.184.216.34:53", nil},
+		{"public ipv6", &DstPolicy{}, "[2606:2800:220:1::1]:443", "[2606:2800:220:1::1]:443", nil},
+		{"loopback", &DstPolicy{}, "127.0.0.1:80", "", ErrDstDenied},
+		{"private", &DstPolicy{}, "10.1.2.3:80", "", ErrDstDenied},
+		{"metadata", &DstPolicy{}, "169.254.169.254:80", "", ErrDstDenied},
+		{"ipv6 loopback", &DstPolicy{}, "[::1]:80", "", ErrDstDenied},
+		{"ipv4 mapped", &DstPolicy{}, "[::ffff:127.0.0.1]:80", "", ErrDstDenied},
+		{"nat64 private", &DstPolicy{}, "[64:ff9b::a9fe:a9fe]:80", "", ErrDstDenied},
+		{"nat64 public", &DstPolicy{}, "[64:ff9b::5db8:d822]:443", "[64:ff9b::5db8:d822]:443", nil},
+		{"nat64 local use", &DstPolicy{}, "[64:ff9b:1::5db8:d822]:443", "", ErrDstDenied},
+		{"6to4 loopback", &DstPolicy{}, "[2002:7f00:1::1]:80", "", ErrDstDenied},
+		{"6to4 public", &DstPolicy{}, "[2002:5db8:d822::1]:443", "[2002:5db8:d822::1]:443", nil},
+		{"allow private", &DstPolicy{AllowPrivate: true}, "127.0.0.1:80", "127.0.0.1:80", nil},
+		{"deny cidr", &DstPolicy{DenyCIDRs: []string{"93.184.0.0/16"}}, "93.184.216.34:443", "", ErrDstDenied},
+		{"deny cidr embedded", &DstPolicy{DenyCIDRs: []string{"93.184.0.0/16"}}, "[64:ff9b::5db8:d822]:443", "", ErrDstDenied},
+		{"port allowed", &DstPolicy{AllowPorts: []int{443}}, "93.184.216.34:443", "93.184.216.34:443", nil},
+		{"port denied", &DstPolicy{AllowPorts: []int{443}}, "93.184.216.34:22", "", ErrDstDenied},
+		{"invalid port", &DstPolicy{}, "93.184.216.34:0", "", ErrDstDenied},
+		{"missing port", &DstPolicy{}, "93.184.216.34", "", ErrDstDenied},
+		{"host allowed", &DstPolicy{AllowHosts: []string{"93.184.216.34"}}, "93.184.216.34:443", "93.184.216.34:443", nil},
+		{"host denied", &DstPolicy{AllowHosts: []string{"*.example.com"}}, "93.184.216.34:443", "", ErrDstDenied},
+		{"check", &DstPolicy{Check: func(string, string, int, []net.IP) error { return errCheck }}, "93.184.216.34:443", "", errCheck},
+	}
+	for _, tt := range tests {
+		got, err := tt.policy.Resolve(tt.addr)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%v: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if got != tt.want {
+			t.Fatalf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDstPolicyHostAllowed(t *testing.T) {
+	policy := &DstPolicy{AllowHosts: []string{"example.com", "*.example.org"}}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com.", true},
+		{"www.example.com", false},
+		{"www.example.org", true},
+		{"example.org", false},
+		{"evilexample.org", false},
+	}
+	for _, tt := range tests {
+		if got := policy.hostAllowed(tt.host); got != tt.want {
+			t.Fatalf("%v: got %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+// resignDstAddr moves the timestamp of a signed header and signs it again.
+func resignDstAddr(secret, b []byte, ts time.Time) []byte {
+	b = append([]byte(nil), b...)
+	binary.BigEndian.PutUint64(b, uint64(ts.Unix()))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(b[:24])
+	mac.Write(b[dstSignatureLen:])
+	copy(b[24:dstSignatureLen], mac.Sum(nil))
+	return b
+}
+
+func TestDstPolicyVerify(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	sign := func() []byte {
+		b, err := signDstAddr(secret, "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	replayed := sign()
+	tampered := sign()
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name   string
+		header []byte
+		err    error
+	}{
+		{"valid", replayed, nil},
+		{"replayed", replayed, ErrDstSignatureOld},
+		{"tampered", tampered, ErrDstSignature},
+		{"short", replayed[:dstSignatureLen-1], ErrDstSignature},
+		{"wrong secret", resignDstAddr([]byte("another secret"), sign(), time.Now()), ErrDstSignature},
+		{"expired", resignDstAddr(secret, sign(), time.Now().Add(-2*time.Minute)), ErrDstSignatureOld},
+		{"future", resignDstAddr(secret, sign(), time.Now().Add(2*time.Minute)), ErrDstSignatureOld},
+		{"within skew", resignDstAddr(secret, sign(), time.Now().Add(-30*time.Second)), nil},
+	}
+	policy := &DstPolicy{Secret: secret}
+	if err := policy.init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		addr, err := policy.verify(tt.header)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%v: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && addr != "example.com:443" {
+			t.Fatalf("%v: got address %q", tt.name, addr)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+var (
+	ErrRetrySrcClosed = errors.New("dial retry: source closed")
+	ErrRetryDeadline  = errors.New("dial retry: deadline exceeded")
+)
+
+// RetryOptions configures WithRetry. Attempts is the number of dials, default
+// 5, negative retries until Deadline. The wait after the first failure is
+// Backoff (default 100ms), doubled after every further failure up to
+// MaxBackoff (default 5s), and moved by a random amount of up to Jitter
+// (default 0.2) times itself so clients don't come back in lockstep. Deadline
+// (default 30s) bounds all attempts and waits together. Retryable decides
+// which errors are worth another attempt, by default all except a denied
+// destination.
+type RetryOptions struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+	Deadline   time.Duration
+	Retryable  func(error) bool
+}
+
+func (o *RetryOptions) init() {
+	if o.Attempts == 0 {
+		o.Attempts = 5
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 5 * time.Second
+	}
+	if o.MaxBackoff < o.Backoff {
+		o.MaxBackoff = o.Backoff
+	}
+	if o.Jitter <= 0 {
+		o.Jitter = 0.2
+	}
+	if o.Jitter > 1 {
+		o.Jitter = 1
+	}
+	if o.Deadline <= 0 {
+		o.Deadline = 30 * time.Second
+	}
+	if o.Retryable == nil {
+		o.Retryable = func(err error) bool {
+			return !errors.Is(err, ErrDstDenied) && !errors.Is(err, ErrNoDstAddr)
+		}
+	}
+}
+
+// how often the source is checked while a dial or a wait is in progress
+const retryPollInterval = 50 * time.Millisecond
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// WithRetry retries dial with exponential backoff and jitter. It gives up
+// when the source conn closes, on either side, while it is still retrying, so
+// the session isn't held open for a client that has already left. A dial
+// still running when WithRetry gives up is closed once it returns.
+//
+// dial must not read from the source: wrap the dialer inside
+// WithReadingDstAddr, not WithReadingDstAddr itself.
+func WithRetry(dial func(net.Conn) (net.Conn, error), opts *RetryOptions) func(net.Conn) (net.Conn, error) {
+	var o RetryOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+
+	return func(src net.Conn) (net.Conn, error) {
+		deadline := time.NewTimer(o.Deadline)
+		defer deadline.Stop()
+		poll := time.NewTicker(retryPollInterval)
+		defer poll.Stop()
+
+		backoff := o.Backoff
+		var lastErr error
+		for attempt := 1; ; attempt++ {
+			chResult := make(chan dialResult, 1)
+			go func() {
+				conn, err := dial(src)
+				chResult <- dialResult{conn, err}
+			}()
+
+			var res dialResult
+		WAIT_DIAL:
+			for {
+				select {
+				case res = <-chResult:
+					break WAIT_DIAL
+				case <-deadline.C:
+					go closeLateDial(chResult)
+					return nil, retryError(ErrRetryDeadline, attempt, lastErr)
+				case <-poll.C:
+					if srcClosed(src) {
+						go closeLateDial(chResult)
+						return nil, retryError(ErrRetrySrcClosed, attempt, lastErr)
+					}
+				}
+			}
+			if res.err == nil {
+				return res.conn, nil
+			}
+			lastErr = res.err
+			if !o.Retryable(lastErr) || (o.Attempts > 0 && attempt >= o.Attempts) {
+				return nil, lastErr
+			}
+
+			wait := time.NewTimer(jitter(backoff, o.Jitter))
+		WAIT_BACKOFF:
+			for {
+				select {
+				case <-wait.C:
+					break WAIT_BACKOFF
+				case <-deadline.C:
+					wait.Stop()
+					return nil, retryError(ErrRetryDeadline, attempt, lastErr)
+				case <-poll.C:
+					if srcClosed(src) {
+						wait.Stop()
+						return nil, retryError(ErrRetrySrcClosed, attempt, lastErr)
+					}
+				}
+			}
+			backoff *= 2
+			if backoff > o.MaxBackoff {
+				backoff = o.MaxBackoff
+			}
+		}
+	}
+}
+
+// srcClosed reports whether src was closed while WithRetry is still dialing.
+// Conns with a Done channel, such as MuxStream, RUDPConn or SOCKS5UDPConn, are
+// asked directly, wrappers like tls.Conn, SOCKS5Conn or HTTPProxyConn are
+// unwrapped down to their socket, which is then peeked if the platform can.
+func srcClosed(src net.Conn) bool {
+	for src != nil {
+		if dc, ok := src.(interface{ Done() <-chan struct{} }); ok {
+			select {
+			case <-dc.Done():
+				return true
+			default:
+				return false
+			}
+		}
+		nc, ok := src.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		src = nc.NetConn()
+	}
+	if src == nil {
+		return false
+	}
+	return socketClosed(src)
+}
+
+func jitter(d time.Duration, factor float64) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*factor*float64(d))
+}
+
+func closeLateDial(chResult chan dialResult) {
+	res := <-chResult
+	if res.conn != nil {
+		res.conn.Close()
+	}
+}
+
+func retryError(reason error, attempts int, lastErr error) error {
+	if lastErr == nil {
+		return fmt.Errorf("%w after %v attempts", reason, attempts)
+	}
+	return fmt.Errorf("%w after %v attempts: %v", reason, attempts, lastErr)
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package protocol
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketClosed only detects local closes where the socket can't be peeked.
+func socketClosed(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return true
+	}
+	return rc.Read(func(uintptr) bool { return true }) != nil
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package protocol
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketClosed peeks at the socket of conn without consuming anything, it
+// reports true if conn was closed locally or the peer has shut it down.
+// Conns that don't expose a socket are never reported closed.
+func socketClosed(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return true
+	}
+
+	closed := false
+	var buf [1]byte
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EWOULDBLOCK || err == syscall.EINTR:
+		case err != nil:
+			closed = true
+		case n == 0:
+			closed = true
+		}
+		return true
+	})
+	return closed || err != nil
+}
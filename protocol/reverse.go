@@ -0,0 +1,394 @@
+package protocol
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/pipe"
+)
+
+var (
+	ErrServiceUnavailable = errors.New("reverse service unavailable")
+	ErrReverseRegister    = errors.New("reverse register rejected")
+	ErrReverseConfig      = errors.New("reverse server requires a Token")
+	ErrServiceRegistered  = errors.New("reverse service already registered")
+)
+
+const reverseRegisterOK = "ok"
+
+// ReverseServer runs on the public side. Agents behind NAT dial its control
+// listener and register service names, then Dial(name) opens a stream back
+// down the agent's control connection, so a pipe like
+//
+//	&pipe.Pipe{Listen: protocol.ListenTCP(":8080"), Dial: rs.Dial("web")}
+//
+// started with StartClient exposes the agent's "web" service on :8080.
+//
+// Control connections are kept alive as set by MuxOptions, an agent that
+// stops answering is unregistered. An agent can't take over a service while
+// another agent serves it, it is rejected and retries until the service is
+// free again.
+type ReverseServer struct {
+	mux sync.Mutex
+
+	Listen     func() (net.Listener, error)
+	Token      string
+	Timeout    time.Duration
+	MuxOptions *MuxOptions
+	Logger     pipe.Logger
+
+	ln      net.Listener
+	agents  map[string]*MuxSession
+	pending map[string]bool
+}
+
+func (rs *ReverseServer) Start() error {
+	if rs.Token == "" {
+		return ErrReverseConfig
+	}
+	ln, err := rs.Listen()
+	if err != nil {
+		return err
+	}
+	rs.mux.Lock()
+	rs.ln = ln
+	if rs.agents == nil {
+		rs.agents = map[string]*MuxSession{}
+	}
+	if rs.pending == nil {
+		rs.pending = map[string]bool{}
+	}
+	rs.mux.Unlock()
+	go rs.accept(ln)
+	return nil
+}
+
+func (rs *ReverseServer) Stop() {
+	rs.mux.Lock()
+	ln := rs.ln
+	agents := rs.agents
+	rs.ln = nil
+	rs.agents = map[string]*MuxSession{}
+	rs.mux.Unlock()
+
+	if ln != nil {
+		ln.Close()
+	}
+	for _, session := range agents {
+		session.Close()
+	}
+}
+
+// Dial returns a dialer that opens a stream to the agent registered for service.
+func (rs *ReverseServer) Dial(service string) func(net.Conn) (net.Conn, error) {
+	return func(src net.Conn) (net.Conn, error) {
+		rs.mux.Lock()
+		session := rs.agents[service]
+		rs.mux.Unlock()
+		if session == nil {
+			return nil, ErrServiceUnavailable
+		}
+		stream, err := session.Open()
+		if err != nil {
+			return nil, err
+		}
+		_, err = pipe.WriteFragment(stream, []byte(service))
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		return stream, nil
+	}
+}
+
+func (rs *ReverseServer) Services() []string {
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	names := make([]string, 0, len(rs.agents))
+	for name := range rs.agents {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (rs *ReverseServer) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go rs.register(conn)
+	}
+}
+
+func (rs *ReverseServer) register(conn net.Conn) {
+	defer pipe.RecoverTo(loggerOf(rs.Logger))
+
+	timeout := rs.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	b, err := pipe.ReadFragment(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	lines := strings.Split(string(b), "\n")
+	token, names := lines[0], lines[1:]
+	if rs.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(rs.Token)) != 1 || len(names) == 0 {
+		loggerOf(rs.Logger).Warn("reverse register rejected", "remote", conn.RemoteAddr().String())
+		pipe.WriteFragment(conn, []byte(ErrReverseRegister.Error()))
+		conn.Close()
+		return
+	}
+	if name, ok := rs.reserve(names); !ok {
+		loggerOf(rs.Logger).Warn("reverse register rejected", "remote", conn.RemoteAddr().String(), "service", name, "err", ErrServiceRegistered)
+		pipe.WriteFragment(conn, []byte(ErrServiceRegistered.Error()))
+		conn.Close()
+		return
+	}
+	_, err = pipe.WriteFragment(conn, []byte(reverseRegisterOK))
+	if err != nil {
+		rs.release(names, nil)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	session := NewMuxSessionWithOptions(conn, false, rs.MuxOptions)
+	rs.mux.Lock()
+	for _, name := range names {
+		delete(rs.pending, name)
+	}
+	if rs.ln == nil {
+		rs.mux.Unlock()
+		session.Close()
+		return
+	}
+	for _, name := range names {
+		rs.agents[name] = session
+	}
+	rs.mux.Unlock()
+	loggerOf(rs.Logger).Info("reverse services registered", "remote", conn.RemoteAddr().String(), "services", names)
+
+	<-session.Done()
+
+	rs.release(names, session)
+	loggerOf(rs.Logger).Info("reverse services unregistered", "remote", conn.RemoteAddr().String(), "services", names, "err", session.closeErr())
+}
+
+// reserve claims names for a registering agent, it fails with the first name
+// that is already served by a live agent or claimed by another registration.
+func (rs *ReverseServer) reserve(names []string) (string, bool) {
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	if rs.ln == nil {
+		return "", false
+	}
+	for _, name := range names {
+		if rs.pending[name] {
+			return name, false
+		}
+		if session := rs.agents[name]; session != nil {
+			select {
+			case <-session.Done():
+			default:
+				return name, false
+			}
+		}
+	}
+	for _, name := range names {
+		rs.pending[name] = true
+	}
+	return "", true
+}
+
+// release drops the names registered by session, or the names reserved by a
+// registration that failed if session is nil.
+func (rs *ReverseServer) release(names []string, session *MuxSession) {
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	for _, name := range names {
+		if session == nil {
+			delete(rs.pending, name)
+		} else if rs.agents[name] == session {
+			delete(rs.agents, name)
+		}
+	}
+}
+
+// ReverseAgent runs behind NAT. Listen keeps a control connection to the
+// ReverseServer, redialing it when it fails or drops, and returns the streams
+// opened by the server; DialService dials the service each stream is for:
+//
+//	&pipe.Pipe{Listen: agent.Listen, Dial: agent.DialService}
+//
+// started with StartServer. The control connection is redialed as well when
+// the server stops answering its keepalives, see MuxOptions.
+type ReverseAgent struct {
+	Dial          func(net.Conn) (net.Conn, error)
+	Token         string
+	Services      map[string]func(net.Conn) (net.Conn, error)
+	RetryInterval time.Duration
+	Timeout       time.Duration
+	MuxOptions    *MuxOptions
+	Logger        pipe.Logger
+}
+
+func (a *ReverseAgent) Listen() (net.Listener, error) {
+	ln := &reverseAgentListener{
+		agent:    a,
+		ch:       make(chan net.Conn, muxAcceptBacklog),
+		chClosed: make(chan struct{}),
+	}
+	go ln.serve()
+	return ln, nil
+}
+
+func (a *ReverseAgent) DialService(src net.Conn) (net.Conn, error) {
+	b, err := pipe.ReadFragment(src)
+	if err != nil {
+		return nil, err
+	}
+	dial, ok := a.Services[string(b)]
+	if !ok {
+		return nil, ErrServiceUnavailable
+	}
+	return dial(src)
+}
+
+func (a *ReverseAgent) connect() (*MuxSession, error) {
+	conn, err := a.Dial(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	names := make([]string, 0, len(a.Services))
+	for name := range a.Services {
+		names = append(names, name)
+	}
+	_, err = pipe.WriteFragment(conn, []byte(a.Token+"\n"+strings.Join(names, "\n")))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b, err := pipe.ReadFragment(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if string(b) != reverseRegisterOK {
+		conn.Close()
+		if string(b) == ErrServiceRegistered.Error() {
+			return nil, ErrServiceRegistered
+		}
+		return nil, ErrReverseRegister
+	}
+	conn.SetDeadline(time.Time{})
+	return NewMuxSessionWithOptions(conn, true, a.MuxOptions), nil
+}
+
+type reverseAgentListener struct {
+	mux sync.Mutex
+
+	agent    *ReverseAgent
+	session  *MuxSession
+	ch       chan net.Conn
+	chClosed chan struct{}
+	closed   int32
+}
+
+func (ln *reverseAgentListener) serve() {
+	defer pipe.RecoverTo(loggerOf(ln.agent.Logger))
+	retryInterval := ln.agent.RetryInterval
+	if retryInterval <= 0 {
+		retryInterval = 3 * time.Second
+	}
+	for {
+		session, err := ln.agent.connect()
+		if err != nil {
+			loggerOf(ln.agent.Logger).Warn("reverse connect failed", "err", err, "retry", retryInterval)
+		} else {
+			ln.mux.Lock()
+			if atomic.LoadInt32(&ln.closed) == 1 {
+				ln.mux.Unlock()
+				session.Close()
+				return
+			}
+			ln.session = session
+			ln.mux.Unlock()
+
+			for {
+				stream, err := session.Accept()
+				if err != nil {
+					break
+				}
+				select {
+				case ln.ch <- stream:
+				case <-ln.chClosed:
+					stream.Close()
+				}
+			}
+		}
+
+		select {
+		case <-ln.chClosed:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func (ln *reverseAgentListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.ch:
+		return c, nil
+	case <-ln.chClosed:
+		return nil, io.EOF
+	}
+}
+
+func (ln *reverseAgentListener) Close() error {
+	if !atomic.CompareAndSwapInt32(&ln.closed, 0, 1) {
+		return nil
+	}
+	close(ln.chClosed)
+	ln.mux.Lock()
+	session := ln.session
+	ln.mux.Unlock()
+	if session != nil {
+		session.CloseWhenIdle()
+	}
+	return nil
+}
+
+// Addr is the local address of the control connection, or a placeholder
+// until it has connected.
+func (ln *reverseAgentListener) Addr() net.Addr {
+	ln.mux.Lock()
+	defer ln.mux.Unlock()
+	if ln.session == nil {
+		return reverseAgentAddr{}
+	}
+	return ln.session.LocalAddr()
+}
+
+type reverseAgentAddr struct{}
+
+func (reverseAgentAddr) Network() string { return "reverse" }
+func (reverseAgentAddr) String() string  { return "reverse-agent" }
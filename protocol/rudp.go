@@ -0,0 +1,1025 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/pipe"
+)
+
+// A reliable, ordered byte stream over UDP in the style of KCP.
+//
+// Every datagram carries one or more segments:
+//
+//	conv(4) | cmd(1) | wnd(2) | ts(4) | sn(4) | una(4) | len(2) | data
+//
+// conv identifies the connection, wnd is the sender's free receive window in
+// segments, una is the next sequence number it expects, so every segment
+// acknowledges everything before una. Data and fin segments are acknowledged
+// one by one with ack segments that echo sn and ts, which drives the RTT
+// estimate, selective acknowledgement and fast retransmission.
+//
+// With FECShards > 0 every datagram is prefixed with fecSeq(4) | type(1), and
+// after each FECShards data datagrams a parity datagram, the XOR of them, is
+// sent so that one lost datagram per group is rebuilt without a retransmit.
+const (
+	rudpCmdPush byte = 1
+	rudpCmdAck  byte = 2
+	rudpCmdFin  byte = 3
+
+	rudpHeadSize    = 21
+	rudpFECHeadSize = 5
+	rudpFECData     = 0
+	rudpFECParity   = 1
+
+	rudpRTOMin       = 100
+	rudpRTOMinNoDel  = 30
+	rudpRTODefault   = 200
+	rudpRTOMax       = 60000
+	rudpLinger       = 10 * time.Second
+	rudpFECMaxGroups = 64
+)
+
+var (
+	ErrRUDPClosed   = errors.New("rudp: connection closed")
+	ErrRUDPDeadLink = errors.New("rudp: dead link")
+)
+
+type RUDPOptions struct {
+	// MTU is the maximum datagram size, default 1400.
+	MTU int
+	// SendWindow and RecvWindow are counted in segments, default 256.
+	SendWindow int
+	RecvWindow int
+	// Interval is the flush interval, default 10ms.
+	Interval time.Duration
+	// NoDelay lowers the minimum RTO from 100ms to 30ms and backs off slower.
+	NoDelay bool
+	// FastResend retransmits a segment once this many later segments were
+	// acknowledged, default 2, negative disables it.
+	FastResend int
+	// NoCongestion disables the congestion window.
+	NoCongestion bool
+	// FECShards adds one parity datagram per FECShards data datagrams, 0
+	// disables FEC. Both ends must use the same value.
+	FECShards int
+	// DeadLink closes the connection after a segment was sent this many
+	// times, default 20.
+	DeadLink int
+}
+
+func (opts *RUDPOptions) init() {
+	if opts.MTU <= 0 {
+		opts.MTU = 1400
+	}
+	if opts.MTU < 256 {
+		opts.MTU = 256
+	}
+	if opts.SendWindow <= 0 {
+		opts.SendWindow = 256
+	}
+	if opts.RecvWindow <= 0 {
+		opts.RecvWindow = 256
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Millisecond
+	}
+	if opts.FastResend == 0 {
+		opts.FastResend = 2
+	}
+	if opts.DeadLink <= 0 {
+		opts.DeadLink = 20
+	}
+}
+
+var rudpEpoch = time.Now()
+
+func rudpNow() uint32 {
+	return uint32(time.Since(rudpEpoch) / time.Millisecond)
+}
+
+func rudpDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+type rudpSegment struct {
+	cmd      byte
+	sn       uint32
+	ts       uint32
+	data     []byte
+	resendAt uint32
+	rto      uint32
+	xmit     int
+	fastack  int
+}
+
+type rudpAck struct {
+	sn uint32
+	ts uint32
+}
+
+// RUDPConn is one reliable UDP connection, it implements net.Conn.
+type RUDPConn struct {
+	mux sync.Mutex
+
+	opts    RUDPOptions
+	conv    uint32
+	mss     int
+	output  func([]byte) error
+	onClose func()
+	laddr   net.Addr
+	raddr   net.Addr
+	fec     *rudpFEC
+
+	sndQueue []*rudpSegment
+	sndBuf   []*rudpSegment
+	sndNxt   uint32
+	sndUna   uint32
+	rmtWnd   uint32
+	cwnd     uint32
+	ssthresh uint32
+	incr     uint32
+
+	rcvNxt   uint32
+	rcvBuf   map[uint32]*rudpSegment
+	rcvQueue []byte
+	rcvFin   bool
+	acks     []rudpAck
+
+	srtt   int32
+	rttvar int32
+	rto    uint32
+
+	closed    bool
+	closedAt  time.Time
+	err       error
+	rDeadline time.Time
+	wDeadline time.Time
+	chRead    chan struct{}
+	chWrite   chan struct{}
+	chDone    chan struct{}
+	done      int32
+}
+
+func newRUDPConn(conv uint32, opts RUDPOptions, laddr, raddr net.Addr, output func([]byte) error) *RUDPConn {
+	c := &RUDPConn{
+		opts:     opts,
+		conv:     conv,
+		laddr:    laddr,
+		raddr:    raddr,
+		rmtWnd:   uint32(opts.RecvWindow),
+		cwnd:     1,
+		ssthresh: 2,
+		rto:      rudpRTODefault,
+		rcvBuf:   map[uint32]*rudpSegment{},
+		chRead:   make(chan struct{}, 1),
+		chWrite:  make(chan struct{}, 1),
+		chDone:   make(chan struct{}),
+	}
+	payload := opts.MTU
+	if opts.FECShards > 0 {
+		c.fec = newRUDPFEC(opts.FECShards)
+		payload -= rudpFECHeadSize + 2
+	}
+	c.mss = payload - rudpHeadSize
+	c.output = func(b []byte) error {
+		if c.fec == nil {
+			return output(b)
+		}
+		for _, pkt := range c.fec.encode(b) {
+			if err := output(pkt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	go c.updateLoop()
+	return c
+}
+
+func (c *RUDPConn) updateLoop() {
+	defer pipe.Recover()
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush()
+		case <-c.chDone:
+			return
+		}
+	}
+}
+
+// input handles one datagram received from the peer.
+func (c *RUDPConn) input(pkt []byte) {
+	if c.fec == nil {
+		c.inputSegments(pkt)
+		return
+	}
+	for _, b := range c.fec.decode(pkt) {
+		c.inputSegments(b)
+	}
+}
+
+func (c *RUDPConn) inputSegments(b []byte) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if atomic.LoadInt32(&c.done) == 1 {
+		return
+	}
+
+	now := rudpNow()
+	oldUna := c.sndUna
+	var maxAck uint32
+	var hasAck, readable bool
+	for len(b) >= rudpHeadSize {
+		conv := binary.LittleEndian.Uint32(b)
+		cmd := b[4]
+		wnd := binary.LittleEndian.Uint16(b[5:])
+		ts := binary.LittleEndian.Uint32(b[7:])
+		sn := binary.LittleEndian.Uint32(b[11:])
+		una := binary.LittleEndian.Uint32(b[15:])
+		l := int(binary.LittleEndian.Uint16(b[19:]))
+		if conv != c.conv || len(b) < rudpHeadSize+l {
+			return
+		}
+		data := b[rudpHeadSize : rudpHeadSize+l]
+		b = b[rudpHeadSize+l:]
+
+		c.rmtWnd = uint32(wnd)
+		c.ackUna(una)
+
+		switch cmd {
+		case rudpCmdAck:
+			if rudpDiff(now, ts) >= 0 {
+				c.updateRTT(rudpDiff(now, ts))
+			}
+			c.ackSn(sn)
+			if !hasAck || rudpDiff(sn, maxAck) > 0 {
+				maxAck, hasAck = sn, true
+			}
+		case rudpCmdPush, rudpCmdFin:
+			if rudpDiff(sn, c.rcvNxt+uint32(c.opts.RecvWindow)) >= 0 {
+				continue
+			}
+			c.acks = append(c.acks, rudpAck{sn: sn, ts: ts})
+			if rudpDiff(sn, c.rcvNxt) < 0 {
+				continue
+			}
+			if _, ok := c.rcvBuf[sn]; !ok {
+				c.rcvBuf[sn] = &rudpSegment{cmd: cmd, sn: sn, data: append([]byte(nil), data...)}
+			}
+			for {
+				seg, ok := c.rcvBuf[c.rcvNxt]
+				if !ok {
+					break
+				}
+				delete(c.rcvBuf, c.rcvNxt)
+				c.rcvNxt++
+				if seg.cmd == rudpCmdFin {
+					c.rcvFin = true
+				} else {
+					c.rcvQueue = append(c.rcvQueue, seg.data...)
+				}
+				readable = true
+			}
+		}
+	}
+
+	if hasAck {
+		for _, seg := range c.sndBuf {
+			if rudpDiff(seg.sn, maxAck) < 0 {
+				seg.fastack++
+			}
+		}
+	}
+
+	if rudpDiff(c.sndUna, oldUna) > 0 {
+		c.growCwnd()
+		notify(c.chWrite)
+	}
+	if readable {
+		notify(c.chRead)
+	}
+}
+
+func (c *RUDPConn) ackUna(una uint32) {
+	i := 0
+	for ; i < len(c.sndBuf); i++ {
+		if rudpDiff(c.sndBuf[i].sn, una) >= 0 {
+			break
+		}
+	}
+	if i > 0 {
+		c.sndBuf = append(c.sndBuf[:0], c.sndBuf[i:]...)
+	}
+	c.updateUna()
+}
+
+func (c *RUDPConn) ackSn(sn uint32) {
+	for i, seg := range c.sndBuf {
+		if seg.sn == sn {
+			c.sndBuf = append(c.sndBuf[:i], c.sndBuf[i+1:]...)
+			break
+		}
+		if rudpDiff(seg.sn, sn) > 0 {
+			break
+		}
+	}
+	c.updateUna()
+}
+
+func (c *RUDPConn) updateUna() {
+	if len(c.sndBuf) > 0 {
+		c.sndUna = c.sndBuf[0].sn
+	} else {
+		c.sndUna = c.sndNxt
+	}
+}
+
+// updateRTT follows RFC 6298.
+func (c *RUDPConn) updateRTT(rtt int32) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := rtt - c.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+		if c.srtt < 1 {
+			c.srtt = 1
+		}
+	}
+	interval := int32(c.opts.Interval / time.Millisecond)
+	if 4*c.rttvar > interval {
+		interval = 4 * c.rttvar
+	}
+	rto := uint32(c.srtt + interval)
+	minRTO := uint32(rudpRTOMin)
+	if c.opts.NoDelay {
+		minRTO = rudpRTOMinNoDel
+	}
+	if rto < minRTO {
+		rto = minRTO
+	}
+	if rto > rudpRTOMax {
+		rto = rudpRTOMax
+	}
+	c.rto = rto
+}
+
+func (c *RUDPConn) growCwnd() {
+	if c.opts.NoCongestion || c.cwnd >= c.rmtWnd {
+		return
+	}
+	if c.cwnd < c.ssthresh {
+		c.cwnd++
+		c.incr = 0
+		return
+	}
+	c.incr++
+	if c.incr >= c.cwnd {
+		c.cwnd++
+		c.incr = 0
+	}
+}
+
+func (c *RUDPConn) rcvWnd() uint16 {
+	used := len(c.rcvBuf) + (len(c.rcvQueue)+c.mss-1)/c.mss
+	if used >= c.opts.RecvWindow {
+		return 0
+	}
+	return uint16(c.opts.RecvWindow - used)
+}
+
+// flush sends pending acks, new segments within the window and
+// retransmissions, it runs every Interval.
+func (c *RUDPConn) flush() {
+	c.mux.Lock()
+	if atomic.LoadInt32(&c.done) == 1 {
+		c.mux.Unlock()
+		return
+	}
+
+	now := rudpNow()
+	wnd := c.rcvWnd()
+	var pkts [][]byte
+	buf := make([]byte, 0, c.mss+rudpHeadSize)
+	write := func(cmd byte, sn, ts uint32, data []byte) {
+		if len(buf)+rudpHeadSize+len(data) > cap(buf) {
+			pkts = append(pkts, buf)
+			buf = make([]byte, 0, c.mss+rudpHeadSize)
+		}
+		var head [rudpHeadSize]byte
+		binary.LittleEndian.PutUint32(head[0:], c.conv)
+		head[4] = cmd
+		binary.LittleEndian.PutUint16(head[5:], wnd)
+		binary.LittleEndian.PutUint32(head[7:], ts)
+		binary.LittleEndian.PutUint32(head[11:], sn)
+		binary.LittleEndian.PutUint32(head[15:], c.rcvNxt)
+		binary.LittleEndian.PutUint16(head[19:], uint16(len(data)))
+		buf = append(buf, head[:]...)
+		buf = append(buf, data...)
+	}
+
+	for _, ack := range c.acks {
+		write(rudpCmdAck, ack.sn, ack.ts, nil)
+	}
+	c.acks = c.acks[:0]
+
+	effWnd := uint32(c.opts.SendWindow)
+	if c.rmtWnd < effWnd {
+		effWnd = c.rmtWnd
+	}
+	if !c.opts.NoCongestion && c.cwnd < effWnd {
+		effWnd = c.cwnd
+	}
+	if effWnd == 0 {
+		// probe a closed window with one segment at a time
+		effWnd = 1
+	}
+	for len(c.sndQueue) > 0 && rudpDiff(c.sndNxt, c.sndUna+effWnd) < 0 {
+		seg := c.sndQueue[0]
+		c.sndQueue = c.sndQueue[1:]
+		seg.sn = c.sndNxt
+		c.sndNxt++
+		c.sndBuf = append(c.sndBuf, seg)
+		notify(c.chWrite)
+	}
+	if len(c.sndQueue) == 0 {
+		c.sndQueue = nil
+	}
+
+	var lost, fastResent bool
+	for _, seg := range c.sndBuf {
+		send := false
+		switch {
+		case seg.xmit == 0:
+			send = true
+			seg.rto = c.rto
+		case rudpDiff(now, seg.resendAt) >= 0:
+			send = true
+			lost = true
+			if c.opts.NoDelay {
+				seg.rto += seg.rto / 2
+			} else {
+				seg.rto *= 2
+			}
+			if seg.rto > rudpRTOMax {
+				seg.rto = rudpRTOMax
+			}
+		case c.opts.FastResend > 0 && seg.fastack >= c.opts.FastResend:
+			send = true
+			fastResent = true
+		}
+		if !send {
+			continue
+		}
+		seg.xmit++
+		seg.fastack = 0
+		seg.ts = now
+		seg.resendAt = now + seg.rto
+		write(seg.cmd, seg.sn, seg.ts, seg.data)
+		if seg.xmit >= c.opts.DeadLink {
+			c.err = ErrRUDPDeadLink
+		}
+	}
+	if len(buf) > 0 {
+		pkts = append(pkts, buf)
+	}
+
+	if !c.opts.NoCongestion {
+		if fastResent {
+			inflight := uint32(len(c.sndBuf))
+			c.ssthresh = inflight / 2
+			if c.ssthresh < 2 {
+				c.ssthresh = 2
+			}
+			c.cwnd = c.ssthresh + uint32(c.opts.FastResend)
+			c.incr = 0
+		}
+		if lost {
+			c.ssthresh = c.cwnd / 2
+			if c.ssthresh < 2 {
+				c.ssthresh = 2
+			}
+			c.cwnd = 1
+			c.incr = 0
+		}
+	}
+
+	finished := false
+	if c.err != nil {
+		finished = true
+	} else if c.closed && len(c.sndQueue) == 0 && len(c.sndBuf) == 0 {
+		finished = true
+	} else if c.closed && time.Since(c.closedAt) > rudpLinger {
+		finished = true
+	}
+	c.mux.Unlock()
+
+	for _, pkt := range pkts {
+		if err := c.output(pkt); err != nil {
+			c.mux.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.mux.Unlock()
+			finished = true
+			break
+		}
+	}
+	if finished {
+		c.release()
+	}
+}
+
+func (c *RUDPConn) release() {
+	if !atomic.CompareAndSwapInt32(&c.done, 0, 1) {
+		return
+	}
+	c.mux.Lock()
+	if c.err == nil {
+		c.err = ErrRUDPClosed
+	}
+	c.mux.Unlock()
+	close(c.chDone)
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+func (c *RUDPConn) Read(b []byte) (int, error) {
+	for {
+		c.mux.Lock()
+		if c.closed {
+			c.mux.Unlock()
+			return 0, ErrRUDPClosed
+		}
+		if len(c.rcvQueue) > 0 {
+			n := copy(b, c.rcvQueue)
+			c.rcvQueue = c.rcvQueue[n:]
+			if len(c.rcvQueue) == 0 {
+				c.rcvQueue = nil
+			}
+			c.mux.Unlock()
+			return n, nil
+		}
+		if c.rcvFin {
+			c.mux.Unlock()
+			return 0, io.EOF
+		}
+		if atomic.LoadInt32(&c.done) == 1 {
+			err := c.err
+			c.mux.Unlock()
+			return 0, err
+		}
+		deadline := c.rDeadline
+		c.mux.Unlock()
+
+		err := wait(c.chRead, c.chDone, deadline)
+		if err == errWaitClosed {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *RUDPConn) Write(b []byte) (int, error) {
+	var nTotal int
+	for len(b) > 0 {
+		c.mux.Lock()
+		if c.closed || atomic.LoadInt32(&c.done) == 1 {
+			err := c.err
+			if err == nil {
+				err = ErrRUDPClosed
+			}
+			c.mux.Unlock()
+			return nTotal, err
+		}
+		if len(c.sndQueue) >= c.opts.SendWindow {
+			deadline := c.wDeadline
+			c.mux.Unlock()
+			err := wait(c.chWrite, c.chDone, deadline)
+			if err != nil && err != errWaitClosed {
+				return nTotal, err
+			}
+			continue
+		}
+		for len(b) > 0 && len(c.sndQueue) < c.opts.SendWindow {
+			n := len(b)
+			if n > c.mss {
+				n = c.mss
+			}
+			c.sndQueue = append(c.sndQueue, &rudpSegment{cmd: rudpCmdPush, data: append([]byte(nil), b[:n]...)})
+			b = b[n:]
+			nTotal += n
+		}
+		c.mux.Unlock()
+	}
+	return nTotal, nil
+}
+
+// Close sends a fin after the queued data, the connection is released once
+// everything was acknowledged, the link is dead or after a linger timeout.
+func (c *RUDPConn) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	c.sndQueue = append(c.sndQueue, &rudpSegment{cmd: rudpCmdFin})
+	notify(c.chRead)
+	notify(c.chWrite)
+	return nil
+}
+
+func (c *RUDPConn) Done() <-chan struct{} {
+	return c.chDone
+}
+
+func (c *RUDPConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *RUDPConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *RUDPConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *RUDPConn) SetReadDeadline(t time.Time) error {
+	c.mux.Lock()
+	c.rDeadline = t
+	c.mux.Unlock()
+	notify(c.chRead)
+	return nil
+}
+
+func (c *RUDPConn) SetWriteDeadline(t time.Time) error {
+	c.mux.Lock()
+	c.wDeadline = t
+	c.mux.Unlock()
+	notify(c.chWrite)
+	return nil
+}
+
+type rudpFECGroup struct {
+	shards [][]byte
+	parity []byte
+	count  int
+	done   bool
+}
+
+type rudpFEC struct {
+	mux sync.Mutex
+
+	shards int
+
+	seq    uint32
+	parity []byte
+	count  int
+
+	groups   map[uint32]*rudpFECGroup
+	maxGroup uint32
+}
+
+func newRUDPFEC(shards int) *rudpFEC {
+	return &rudpFEC{shards: shards, groups: map[uint32]*rudpFECGroup{}}
+}
+
+// fecXOR xors len(2) | b into parity, growing it as needed.
+func fecXOR(parity []byte, b []byte) []byte {
+	for len(parity) < 2+len(b) {
+		parity = append(parity, 0)
+	}
+	parity[0] ^= byte(len(b))
+	parity[1] ^= byte(len(b) >> 8)
+	for i, v := range b {
+		parity[2+i] ^= v
+	}
+	return parity
+}
+
+func (f *rudpFEC) encode(b []byte) [][]byte {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	pkt := make([]byte, rudpFECHeadSize+len(b))
+	binary.LittleEndian.PutUint32(pkt, f.seq)
+	pkt[4] = rudpFECData
+	copy(pkt[rudpFECHeadSize:], b)
+	f.seq++
+	f.parity = fecXOR(f.parity, b)
+	f.count++
+	if f.count < f.shards {
+		return [][]byte{pkt}
+	}
+
+	parity := make([]byte, rudpFECHeadSize+len(f.parity))
+	binary.LittleEndian.PutUint32(parity, f.seq)
+	parity[4] = rudpFECParity
+	copy(parity[rudpFECHeadSize:], f.parity)
+	f.seq++
+	f.parity = f.parity[:0]
+	f.count = 0
+	return [][]byte{pkt, parity}
+}
+
+// decode returns the payload of pkt, plus the datagram it allowed to rebuild.
+func (f *rudpFEC) decode(pkt []byte) [][]byte {
+	if len(pkt) < rudpFECHeadSize {
+		return nil
+	}
+	seq := binary.LittleEndian.Uint32(pkt)
+	typ := pkt[4]
+	payload := pkt[rudpFECHeadSize:]
+	groupSize := uint32(f.shards + 1)
+	gid, idx := seq/groupSize, int(seq%groupSize)
+	if (typ == rudpFECParity) != (idx == f.shards) {
+		return nil
+	}
+
+	var out [][]byte
+	if typ == rudpFECData {
+		out = append(out, payload)
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if rudpDiff(gid, f.maxGroup) > 0 {
+		f.maxGroup = gid
+		for id := range f.groups {
+			if rudpDiff(f.maxGroup, id) >= rudpFECMaxGroups {
+				delete(f.groups, id)
+			}
+		}
+	} else if rudpDiff(f.maxGroup, gid) >= rudpFECMaxGroups {
+		return out
+	}
+	g := f.groups[gid]
+	if g == nil {
+		g = &rudpFECGroup{shards: make([][]byte, f.shards)}
+		f.groups[gid] = g
+	}
+	if g.done {
+		return out
+	}
+	if typ == rudpFECParity {
+		if g.parity != nil {
+			return out
+		}
+		g.parity = append([]byte(nil), payload...)
+	} else {
+		if g.shards[idx] != nil {
+			return out
+		}
+		g.shards[idx] = append([]byte(nil), payload...)
+		g.count++
+	}
+
+	if g.count == f.shards {
+		g.done = true
+		return out
+	}
+	if g.count == f.shards-1 && g.parity != nil {
+		g.done = true
+		rebuilt := append([]byte(nil), g.parity...)
+		for _, shard := range g.shards {
+			if shard != nil {
+				rebuilt = fecXOR(rebuilt, shard)
+			}
+		}
+		if len(rebuilt) >= 2 {
+			l := int(rebuilt[0]) | int(rebuilt[1])<<8
+			if l <= len(rebuilt)-2 {
+				out = append(out, rebuilt[2:2+l])
+			}
+		}
+	}
+	return out
+}
+
+type RUDPListener struct {
+	mux sync.Mutex
+
+	uc       *net.UDPConn
+	opts     RUDPOptions
+	conns    map[string]*RUDPConn
+	ch       chan net.Conn
+	chClosed chan struct{}
+	closed   bool
+}
+
+func (ln *RUDPListener) readLoop() {
+	defer pipe.Recover()
+	buf := make([]byte, 65536)
+	for {
+		n, raddr, err := ln.uc.ReadFromUDP(buf)
+		if err != nil {
+			ln.mux.Lock()
+			conns := ln.conns
+			ln.conns = map[string]*RUDPConn{}
+			ln.mux.Unlock()
+			for _, c := range conns {
+				c.release()
+			}
+			return
+		}
+		pkt := append([]byte(nil), buf[:n]...)
+		conv, open, ok := rudpParse(pkt, ln.opts.FECShards > 0)
+
+		saddr := raddr.String()
+		ln.mux.Lock()
+		c := ln.conns[saddr]
+		if c == nil && (!ok || !open || ln.closed) {
+			ln.mux.Unlock()
+			continue
+		}
+		if c != nil && ok && c.conv != conv {
+			ln.mux.Unlock()
+			continue
+		}
+		if c == nil {
+			addr := raddr
+			c = newRUDPConn(conv, ln.opts, ln.uc.LocalAddr(), addr, func(b []byte) error {
+				_, err := ln.uc.WriteToUDP(b, addr)
+				return err
+			})
+			nc := c
+			c.onClose = func() {
+				ln.removeConn(saddr, nc)
+			}
+			ln.conns[saddr] = c
+			select {
+			case ln.ch <- c:
+			default:
+				delete(ln.conns, saddr)
+				ln.mux.Unlock()
+				c.release()
+				continue
+			}
+		}
+		ln.mux.Unlock()
+		c.input(pkt)
+	}
+}
+
+// rudpParse returns the conv of a datagram and whether it opens a connection,
+// that is it carries the first data segment. FEC parity datagrams have no
+// conv and are routed by address only.
+func rudpParse(pkt []byte, fec bool) (conv uint32, open bool, ok bool) {
+	if fec {
+		if len(pkt) < rudpFECHeadSize || pkt[4] == rudpFECParity {
+			return 0, false, false
+		}
+		pkt = pkt[rudpFECHeadSize:]
+	}
+	if len(pkt) < rudpHeadSize {
+		return 0, false, false
+	}
+	conv = binary.LittleEndian.Uint32(pkt)
+	for len(pkt) >= rudpHeadSize {
+		l := int(binary.LittleEndian.Uint16(pkt[19:]))
+		if pkt[4] == rudpCmdPush && binary.LittleEndian.Uint32(pkt[11:]) == 0 {
+			open = true
+		}
+		if len(pkt) < rudpHeadSize+l {
+			break
+		}
+		pkt = pkt[rudpHeadSize+l:]
+	}
+	return conv, open, true
+}
+
+func (ln *RUDPListener) removeConn(saddr string, c *RUDPConn) {
+	ln.mux.Lock()
+	if ln.conns[saddr] == c {
+		delete(ln.conns, saddr)
+	}
+	closeSocket := ln.closed && len(ln.conns) == 0
+	ln.mux.Unlock()
+	if closeSocket {
+		ln.uc.Close()
+	}
+}
+
+func (ln *RUDPListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.ch:
+		return c, nil
+	case <-ln.chClosed:
+		return nil, io.EOF
+	}
+}
+
+// Close stops accepting, the socket is closed once the accepted connections
+// are released.
+func (ln *RUDPListener) Close() error {
+	ln.mux.Lock()
+	if ln.closed {
+		ln.mux.Unlock()
+		return nil
+	}
+	ln.closed = true
+	close(ln.chClosed)
+	closeSocket := len(ln.conns) == 0
+	ln.mux.Unlock()
+	if closeSocket {
+		return ln.uc.Close()
+	}
+	return nil
+}
+
+func (ln *RUDPListener) Addr() net.Addr {
+	return ln.uc.LocalAddr()
+}
+
+func ListenRUDP(addr string, opts *RUDPOptions) func() (net.Listener, error) {
+	return func() (net.Listener, error) {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		uc, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		ln := &RUDPListener{
+			uc:       uc,
+			conns:    map[string]*RUDPConn{},
+			ch:       make(chan net.Conn, 1024),
+			chClosed: make(chan struct{}),
+		}
+		if opts != nil {
+			ln.opts = *opts
+		}
+		ln.opts.init()
+		go ln.readLoop()
+		return ln, nil
+	}
+}
+
+func DialRUDP(dstAddr string, opts *RUDPOptions) func(net.Conn) (net.Conn, error) {
+	var o RUDPOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.init()
+	return func(src net.Conn) (net.Conn, error) {
+		udpAddr, err := net.ResolveUDPAddr("udp", dstAddr)
+		if err != nil {
+			return nil, err
+		}
+		uc, err := net.DialUDP("udp", nil, udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		var b [4]byte
+		_, err = rand.Read(b[:])
+		if err != nil {
+			uc.Close()
+			return nil, err
+		}
+		c := newRUDPConn(binary.LittleEndian.Uint32(b[:]), o, uc.LocalAddr(), udpAddr, func(b []byte) error {
+			_, err := uc.Write(b)
+			return err
+		})
+		c.onClose = func() {
+			uc.Close()
+		}
+		go func() {
+			defer pipe.Recover()
+			buf := make([]byte, 65536)
+			for {
+				n, err := uc.Read(buf)
+				if err != nil {
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						continue
+					}
+					c.release()
+					return
+				}
+				c.input(append([]byte(nil), buf[:n]...))
+			}
+		}()
+		return c, nil
+	}
+}
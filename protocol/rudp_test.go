@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyLink delivers datagrams to a conn after a random delay, so they arrive
+// out of order, and drops a share of them.
+type lossyLink struct {
+	mux    sync.Mutex
+	random *mrand.Rand
+	loss   float64
+	delay  time.Duration
+	dst    *RUDPConn
+}
+
+func (l *lossyLink) send(b []byte) error {
+	l.mux.Lock()
+	drop := l.random.Float64() < l.loss
+	delay := time.Duration(l.random.Int63n(int64(l.delay)))
+	l.mux.Unlock()
+	if drop {
+		return nil
+	}
+	pkt := append([]byte(nil), b...)
+	time.AfterFunc(delay, func() { l.dst.input(pkt) })
+	return nil
+}
+
+func newLossyPair(t *testing.T, opts RUDPOptions, loss float64) (*RUDPConn, *RUDPConn) {
+	opts.init()
+	addrA := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+	addrB := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10002}
+	toA := &lossyLink{random: mrand.New(mrand.NewSource(1)), loss: loss, delay: 20 * time.Millisecond}
+	toB := &lossyLink{random: mrand.New(mrand.NewSource(2)), loss: loss, delay: 20 * time.Millisecond}
+	a := newRUDPConn(7, opts, addrA, addrB, toB.send)
+	b := newRUDPConn(7, opts, addrB, addrA, toA.send)
+	toA.dst, toB.dst = a, b
+	t.Cleanup(func() {
+		a.release()
+		b.release()
+	})
+	return a, b
+}
+
+func testRUDPRoundTrip(t *testing.T, opts RUDPOptions, loss float64) {
+	a, b := newLossyPair(t, opts, loss)
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	go func() {
+		a.Write(data)
+		a.Close()
+	}()
+
+	chResult := make(chan []byte, 1)
+	go func() {
+		got, _ := io.ReadAll(b)
+		chResult <- got
+	}()
+	select {
+	case got := <-chResult:
+		if !bytes.Equal(got, data) {
+			t.Fatalf("received %v bytes, want the %v bytes sent", len(got), len(data))
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("transfer timed out")
+	}
+}
+
+func TestRUDPRoundTrip(t *testing.T) {
+	testRUDPRoundTrip(t, RUDPOptions{}, 0)
+}
+
+func TestRUDPRoundTripLossReorder(t *testing.T) {
+	testRUDPRoundTrip(t, RUDPOptions{NoDelay: true}, 0.1)
+}
+
+func TestRUDPRoundTripFEC(t *testing.T) {
+	testRUDPRoundTrip(t, RUDPOptions{NoDelay: true, FECShards: 4}, 0.05)
+}
@@ -0,0 +1,639 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lesismal/pipe"
+)
+
+const (
+	socks5Version = 5
+
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AuthNoAccept = 0xFF
+
+	socks5CmdConnect      = 1
+	socks5CmdUDPAssociate = 3
+
+	socks5AtypIPv4   = 1
+	socks5AtypDomain = 3
+	socks5AtypIPv6   = 4
+
+	socks5RepSuccess             = 0
+	socks5RepFailure             = 1
+	socks5RepHostUnreachable     = 4
+	socks5RepCmdNotSupported     = 7
+	socks5RepAddrTypeUnsupported = 8
+)
+
+var (
+	ErrSOCKS5Version = errors.New("socks5: invalid version")
+	ErrSOCKS5Auth    = errors.New("socks5: authentication failed")
+	ErrSOCKS5Command = errors.New("socks5: unsupported command")
+	ErrSOCKS5Addr    = errors.New("socks5: invalid address")
+)
+
+// DstConn is implemented by conns whose destination is chosen per connection
+// by the client, such as the ones accepted from ListenSOCKS5.
+type DstConn interface {
+	net.Conn
+	DstNetwork() string
+	DstAddr() string
+}
+
+type SOCKS5Options struct {
+	Username string
+	Password string
+	Timeout  time.Duration
+	Logger   pipe.Logger
+}
+
+type SOCKS5Listener struct {
+	ln       net.Listener
+	opts     SOCKS5Options
+	ch       chan net.Conn
+	chClosed chan struct{}
+	closed   int32
+}
+
+func (ln *SOCKS5Listener) accept() {
+	for {
+		conn, err := ln.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			ln.Close()
+			return
+		}
+		go ln.handshake(conn)
+	}
+}
+
+func (ln *SOCKS5Listener) handshake(conn net.Conn) {
+	defer pipe.RecoverTo(loggerOf(ln.opts.Logger))
+
+	timeout := ln.opts.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	cmd, dstAddr, err := ln.negotiate(conn)
+	if err != nil {
+		loggerOf(ln.opts.Logger).Warn("socks5 handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch cmd {
+	case socks5CmdConnect:
+		ln.push(&SOCKS5Conn{Conn: conn, dstAddr: dstAddr})
+	case socks5CmdUDPAssociate:
+		ln.associate(conn, dstAddr)
+	}
+}
+
+func (ln *SOCKS5Listener) negotiate(conn net.Conn) (byte, string, error) {
+	head := make([]byte, 2)
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return 0, "", err
+	}
+	if head[0] != socks5Version {
+		return 0, "", ErrSOCKS5Version
+	}
+	methods := make([]byte, head[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return 0, "", err
+	}
+
+	method := byte(socks5AuthNone)
+	if ln.opts.Username != "" || ln.opts.Password != "" {
+		method = socks5AuthPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return 0, "", ErrSOCKS5Auth
+	}
+	_, err = conn.Write([]byte{socks5Version, method})
+	if err != nil {
+		return 0, "", err
+	}
+	if method == socks5AuthPassword {
+		err = ln.authenticate(conn)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+
+	req := make([]byte, 3)
+	_, err = io.ReadFull(conn, req)
+	if err != nil {
+		return 0, "", err
+	}
+	if req[0] != socks5Version {
+		return 0, "", ErrSOCKS5Version
+	}
+	dstAddr, err := readSOCKS5Addr(conn)
+	if err != nil {
+		if err == ErrSOCKS5Addr {
+			writeSOCKS5Reply(conn, socks5RepAddrTypeUnsupported, nil)
+		}
+		return 0, "", err
+	}
+	if req[1] != socks5CmdConnect && req[1] != socks5CmdUDPAssociate {
+		writeSOCKS5Reply(conn, socks5RepCmdNotSupported, nil)
+		return 0, "", ErrSOCKS5Command
+	}
+	return req[1], dstAddr, nil
+}
+
+// authenticate runs the username/password sub-negotiation of RFC 1929.
+func (ln *SOCKS5Listener) authenticate(conn net.Conn) error {
+	head := make([]byte, 2)
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return err
+	}
+	username := make([]byte, head[1])
+	_, err = io.ReadFull(conn, username)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, head[1:])
+	if err != nil {
+		return err
+	}
+	password := make([]byte, head[1])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return err
+	}
+
+	userOK := subtle.ConstantTimeCompare(username, []byte(ln.opts.Username)) == 1
+	passOK := subtle.ConstantTimeCompare(password, []byte(ln.opts.Password)) == 1
+	if head[0] != 1 || !userOK || !passOK {
+		conn.Write([]byte{1, 1})
+		return ErrSOCKS5Auth
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
+
+// associate relays the datagrams of one UDP ASSOCIATE request, each
+// destination becomes a conn accepted from the listener. The association
+// ends when the control connection is closed.
+func (ln *SOCKS5Listener) associate(ctrl net.Conn, clientAddr string) {
+	defer ctrl.Close()
+
+	localIP := ctrl.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		writeSOCKS5Reply(ctrl, socks5RepFailure, nil)
+		return
+	}
+	defer relay.Close()
+
+	err = writeSOCKS5Reply(ctrl, socks5RepSuccess, relay.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return
+	}
+
+	a := &socks5Association{
+		ln:       ln,
+		relay:    relay,
+		clientIP: ctrl.RemoteAddr().(*net.TCPAddr).IP,
+		conns:    map[string]*SOCKS5UDPConn{},
+	}
+	if host, port, err := net.SplitHostPort(clientAddr); err == nil && port != "0" {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			a.clientIP = ip
+		}
+		a.clientPort, _ = strconv.Atoi(port)
+	}
+	go a.serve()
+
+	io.Copy(io.Discard, ctrl)
+	a.close()
+}
+
+func (ln *SOCKS5Listener) push(c net.Conn) {
+	select {
+	case ln.ch <- c:
+	case <-ln.chClosed:
+		c.Close()
+	}
+}
+
+func (ln *SOCKS5Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.ch:
+		return c, nil
+	case <-ln.chClosed:
+		return nil, io.EOF
+	}
+}
+
+func (ln *SOCKS5Listener) Close() error {
+	if atomic.CompareAndSwapInt32(&ln.closed, 0, 1) {
+		close(ln.chClosed)
+		return ln.ln.Close()
+	}
+	return nil
+}
+
+func (ln *SOCKS5Listener) Addr() net.Addr {
+	return ln.ln.Addr()
+}
+
+// ListenSOCKS5 accepts SOCKS5 clients, each accepted conn is a DstConn for a
+// CONNECT request or for one destination of a UDP ASSOCIATE request. Use it
+// with WithWritingConnDstAddr to let the remote pipe dial the destination.
+func ListenSOCKS5(addr string, opts *SOCKS5Options) func() (net.Listener, error) {
+	return func() (net.Listener, error) {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		ln := &SOCKS5Listener{
+			ln:       l,
+			ch:       make(chan net.Conn, 1024),
+			chClosed: make(chan struct{}),
+		}
+		if opts != nil {
+			ln.opts = *opts
+		}
+		go ln.accept()
+		return ln, nil
+	}
+}
+
+// SOCKS5Conn is a CONNECT request, the reply is sent on the first Read or
+// Write after the pipe has dialed, or as a failure if it is closed before.
+type SOCKS5Conn struct {
+	net.Conn
+
+	mux     sync.Mutex
+	dstAddr string
+	replied bool
+}
+
+func (c *SOCKS5Conn) DstNetwork() string {
+	return "tcp"
+}
+
+func (c *SOCKS5Conn) DstAddr() string {
+	return c.dstAddr
+}
+
+func (c *SOCKS5Conn) reply(rep byte) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.replied {
+		return nil
+	}
+	c.replied = true
+	var bind *net.TCPAddr
+	if rep == socks5RepSuccess {
+		bind, _ = c.Conn.LocalAddr().(*net.TCPAddr)
+	}
+	return writeSOCKS5Reply(c.Conn, rep, bind)
+}
+
+// NetConn returns the client's TCP connection.
+func (c *SOCKS5Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *SOCKS5Conn) Read(b []byte) (int, error) {
+	err := c.reply(socks5RepSuccess)
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *SOCKS5Conn) Write(b []byte) (int, error) {
+	err := c.reply(socks5RepSuccess)
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *SOCKS5Conn) Close() error {
+	c.reply(socks5RepHostUnreachable)
+	return c.Conn.Close()
+}
+
+type socks5Association struct {
+	mux sync.Mutex
+
+	ln         *SOCKS5Listener
+	relay      *net.UDPConn
+	clientIP   net.IP
+	clientPort int
+	client     *net.UDPAddr
+	conns      map[string]*SOCKS5UDPConn
+	closed     bool
+}
+
+func (a *socks5Association) serve() {
+	defer pipe.RecoverTo(loggerOf(a.ln.opts.Logger))
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			a.close()
+			return
+		}
+		if !from.IP.Equal(a.clientIP) || (a.clientPort != 0 && from.Port != a.clientPort) {
+			continue
+		}
+		// RSV(2) | FRAG(1) | ATYP | DST.ADDR | DST.PORT | DATA, fragments are not supported
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		dstAddr, err := readSOCKS5Addr(r)
+		if err != nil {
+			continue
+		}
+		payload := append([]byte(nil), buf[n-r.Len():n]...)
+
+		a.mux.Lock()
+		if a.closed {
+			a.mux.Unlock()
+			return
+		}
+		a.client = from
+		c, ok := a.conns[dstAddr]
+		if !ok {
+			c = &SOCKS5UDPConn{
+				assoc:    a,
+				dstAddr:  dstAddr,
+				chData:   make(chan []byte, 1024),
+				chClosed: make(chan struct{}),
+			}
+			a.conns[dstAddr] = c
+		}
+		a.mux.Unlock()
+
+		if !ok {
+			go a.ln.push(c)
+		}
+		select {
+		case c.chData <- payload:
+		default:
+		}
+	}
+}
+
+func (a *socks5Association) close() {
+	a.mux.Lock()
+	if a.closed {
+		a.mux.Unlock()
+		return
+	}
+	a.closed = true
+	conns := a.conns
+	a.conns = map[string]*SOCKS5UDPConn{}
+	a.mux.Unlock()
+
+	a.relay.Close()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (a *socks5Association) remove(c *SOCKS5UDPConn) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.conns[c.dstAddr] == c {
+		delete(a.conns, c.dstAddr)
+	}
+}
+
+// SOCKS5UDPConn carries the datagrams between a UDP ASSOCIATE client and one
+// destination, every Read returns one datagram.
+type SOCKS5UDPConn struct {
+	assoc    *socks5Association
+	dstAddr  string
+	chData   chan []byte
+	chClosed chan struct{}
+	closed   int32
+	rTimer   *time.Timer
+	mux      sync.Mutex
+}
+
+func (c *SOCKS5UDPConn) DstNetwork() string {
+	return "udp"
+}
+
+func (c *SOCKS5UDPConn) DstAddr() string {
+	return c.dstAddr
+}
+
+func (c *SOCKS5UDPConn) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-c.chData:
+		if len(pkt) > len(b) {
+			return copy(b, pkt), io.ErrShortBuffer
+		}
+		return copy(b, pkt), nil
+	case <-c.chClosed:
+		return 0, io.EOF
+	}
+}
+
+// ReadDatagram is Read for pipe.DatagramReader, a datagram larger than b is
+// dropped with pipe.ErrDatagramTooLarge so the session can go on.
+func (c *SOCKS5UDPConn) ReadDatagram(b []byte) (int, error) {
+	select {
+	case pkt := <-c.chData:
+		if len(pkt) > len(b) {
+			return 0, pipe.ErrDatagramTooLarge
+		}
+		return copy(b, pkt), nil
+	case <-c.chClosed:
+		return 0, io.EOF
+	}
+}
+
+func (c *SOCKS5UDPConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return 0, net.ErrClosed
+	}
+	c.assoc.mux.Lock()
+	client := c.assoc.client
+	c.assoc.mux.Unlock()
+
+	host, port, err := net.SplitHostPort(c.dstAddr)
+	if err != nil {
+		return 0, err
+	}
+	var pkt bytes.Buffer
+	pkt.Write([]byte{0, 0, 0})
+	err = writeSOCKS5HostPort(&pkt, host, port)
+	if err != nil {
+		return 0, err
+	}
+	pkt.Write(b)
+	_, err = c.assoc.relay.WriteToUDP(pkt.Bytes(), client)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *SOCKS5UDPConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		close(c.chClosed)
+		c.assoc.remove(c)
+	}
+	return nil
+}
+
+func (c *SOCKS5UDPConn) Done() <-chan struct{} {
+	return c.chClosed
+}
+
+func (c *SOCKS5UDPConn) LocalAddr() net.Addr {
+	return c.assoc.relay.LocalAddr()
+}
+
+func (c *SOCKS5UDPConn) RemoteAddr() net.Addr {
+	c.assoc.mux.Lock()
+	defer c.assoc.mux.Unlock()
+	return c.assoc.client
+}
+
+func (c *SOCKS5UDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline closes the conn when the deadline passes, like UDPConn.
+func (c *SOCKS5UDPConn) SetReadDeadline(t time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.rTimer == nil {
+		if !t.IsZero() {
+			c.rTimer = time.AfterFunc(time.Until(t), func() {
+				c.Close()
+			})
+		}
+	} else {
+		if !t.IsZero() {
+			c.rTimer.Reset(time.Until(t))
+		} else {
+			c.rTimer.Stop()
+		}
+	}
+	return nil
+}
+
+func (c *SOCKS5UDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func readSOCKS5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(r, ip)
+		if err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		_, err = io.ReadFull(r, l)
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, l[0])
+		_, err = io.ReadFull(r, domain)
+		if err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", ErrSOCKS5Addr
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func writeSOCKS5HostPort(buf *bytes.Buffer, host, port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 0xFFFF {
+		return ErrSOCKS5Addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf.WriteByte(socks5AtypIPv4)
+			buf.Write(ip4)
+		} else {
+			buf.WriteByte(socks5AtypIPv6)
+			buf.Write(ip.To16())
+		}
+	} else {
+		if len(host) > 255 {
+			return ErrSOCKS5Addr
+		}
+		buf.WriteByte(socks5AtypDomain)
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	}
+	buf.Write([]byte{byte(p >> 8), byte(p)})
+	return nil
+}
+
+func writeSOCKS5Reply(w io.Writer, rep byte, bind interface{}) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{socks5Version, rep, 0})
+	var ip net.IP
+	var port int
+	switch addr := bind.(type) {
+	case *net.TCPAddr:
+		if addr != nil {
+			ip, port = addr.IP, addr.Port
+		}
+	case *net.UDPAddr:
+		if addr != nil {
+			ip, port = addr.IP, addr.Port
+		}
+	}
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	writeSOCKS5HostPort(&buf, ip.String(), strconv.Itoa(port))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
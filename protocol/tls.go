@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+var ErrTLSCertificate = errors.New("tls: no certificate configured")
+
+// TLSOptions builds the tls.Config for ListenTLS and DialTLS.
+//
+// On the server, Certificates or CertFile/KeyFile are required; setting
+// CAFile or CAPool verifies client certificates (mutual TLS) unless
+// ClientAuth says otherwise. On the client, CAFile or CAPool replaces the
+// system roots and Certificates or CertFile/KeyFile is sent to the server.
+type TLSOptions struct {
+	CertFile     string
+	KeyFile      string
+	Certificates []tls.Certificate
+
+	CAFile string
+	CAPool *x509.CertPool
+
+	ServerName         string
+	NextProtos         []string
+	ClientAuth         tls.ClientAuthType
+	InsecureSkipVerify bool
+}
+
+func (opts *TLSOptions) certificates() ([]tls.Certificate, error) {
+	certs := opts.Certificates
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(append([]tls.Certificate{}, certs...), cert)
+	}
+	return certs, nil
+}
+
+func (opts *TLSOptions) caPool() (*x509.CertPool, error) {
+	if opts.CAFile == "" {
+		return opts.CAPool, nil
+	}
+	pool := opts.CAPool
+	if pool == nil {
+		pool = x509.NewCertPool()
+	} else {
+		pool = pool.Clone()
+	}
+	pem, err := os.ReadFile(opts.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("tls: no certificates found in " + opts.CAFile)
+	}
+	return pool, nil
+}
+
+func (opts *TLSOptions) ServerConfig() (*tls.Config, error) {
+	certs, err := opts.certificates()
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, ErrTLSCertificate
+	}
+	pool, err := opts.caPool()
+	if err != nil {
+		return nil, err
+	}
+	clientAuth := opts.ClientAuth
+	if pool != nil && clientAuth == tls.NoClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: certs,
+		ClientCAs:    pool,
+		ClientAuth:   clientAuth,
+		NextProtos:   opts.NextProtos,
+	}, nil
+}
+
+func (opts *TLSOptions) ClientConfig() (*tls.Config, error) {
+	certs, err := opts.certificates()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := opts.caPool()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		Certificates:       certs,
+		RootCAs:            pool,
+		ServerName:         opts.ServerName,
+		NextProtos:         opts.NextProtos,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}, nil
+}
+
+func ListenTLS(addr string, config *tls.Config) func() (net.Listener, error) {
+	return func() (net.Listener, error) {
+		return tls.Listen("tcp", addr, config)
+	}
+}
+
+func DialTLS(dstAddr string, config *tls.Config) func(net.Conn) (net.Conn, error) {
+	return func(src net.Conn) (net.Conn, error) {
+		return tls.Dial("tcp", dstAddr, config)
+	}
+}
+
+func DialTLSWithTimeout(dstAddr string, config *tls.Config, timeout time.Duration) func(net.Conn) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return func(src net.Conn) (net.Conn, error) {
+		return tls.DialWithDialer(dialer, "tcp", dstAddr, config)
+	}
+}
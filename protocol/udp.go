@@ -7,6 +7,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/lesismal/pipe"
 )
 
 type UDPConn struct {
@@ -24,6 +26,7 @@ type UDPConn struct {
 	parent   *net.UDPConn
 	rTimer   *time.Timer
 	wTimer   *time.Timer
+	active   int64
 }
 
 func (conn *UDPConn) Read(b []byte) (n int, err error) {
@@ -57,11 +60,11 @@ func (conn *UDPConn) Read(b []byte) (n int, err error) {
 		}
 		return n, nil
 	}
-	pkt, ok = <-conn.chData
+	select {
+	case pkt, ok = <-conn.chData:
+	case <-conn.chClsoed:
+	}
 	if !ok {
-		if n > 0 {
-			return n, nil
-		}
 		return n, io.EOF
 	}
 CP:
@@ -73,6 +76,38 @@ CP:
 	return n, nil
 }
 
+// ReadDatagram returns exactly one datagram, unlike Read which may merge
+// queued datagrams into b.
+func (conn *UDPConn) ReadDatagram(b []byte) (int, error) {
+	if conn.isClient {
+		n, err := conn.raw.Read(b)
+		if err == nil && n == len(b) {
+			// the datagram may have been truncated to len(b)
+			return 0, pipe.ErrDatagramTooLarge
+		}
+		return n, err
+	}
+
+	if atomic.LoadInt32(&conn.closed) == 1 {
+		return 0, io.EOF
+	}
+
+	pkt := conn.cache
+	if len(pkt) > 0 {
+		conn.cache = conn.cache[:0]
+	} else {
+		select {
+		case pkt = <-conn.chData:
+		case <-conn.chClsoed:
+			return 0, io.EOF
+		}
+	}
+	if len(pkt) > len(b) {
+		return 0, pipe.ErrDatagramTooLarge
+	}
+	return copy(b, pkt), nil
+}
+
 func (conn *UDPConn) Write(b []byte) (n int, err error) {
 	if conn.isClient {
 		return conn.raw.Write(b)
@@ -81,6 +116,7 @@ func (conn *UDPConn) Write(b []byte) (n int, err error) {
 	if atomic.CompareAndSwapInt32(&conn.wrote, 0, 1) {
 		close(conn.chWrote)
 	}
+	atomic.StoreInt64(&conn.active, time.Now().UnixNano())
 	return conn.parent.WriteToUDP(b, conn.raddr)
 }
 
@@ -93,7 +129,6 @@ func (conn *UDPConn) Close() error {
 		if conn.fClose != nil {
 			conn.fClose()
 		}
-		close(conn.chData)
 		close(conn.chClsoed)
 	}
 	return err
@@ -154,6 +189,58 @@ func (conn *UDPConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+const (
+	// UDPQueueDrop drops the new datagram when a session's queue is full.
+	UDPQueueDrop = iota
+	// UDPQueueDropOldest drops the oldest queued datagram to make room.
+	UDPQueueDropOldest
+	// UDPQueueBlock stalls the listener until the session catches up, the
+	// socket buffer then absorbs or drops the excess for every session.
+	UDPQueueBlock
+)
+
+// UDPOptions configures ListenUDPWithOptions.
+//
+// IdleTimeout closes sessions that neither received nor sent a datagram for
+// that long, it defaults to 2 minutes, a negative value disables it.
+// MaxSessions limits concurrent sessions, datagrams from new addresses are
+// dropped beyond it. ReadBufferSize is the largest datagram accepted, larger
+// ones are dropped and counted as truncated, it defaults to 65535. QueueSize
+// is the number of datagrams buffered per session and QueuePolicy says what
+// happens when it is full. ACL drops datagrams from disallowed sources before
+// a session is created for them.
+type UDPOptions struct {
+	IdleTimeout    time.Duration
+	MaxSessions    int
+	ReadBufferSize int
+	QueueSize      int
+	QueuePolicy    int
+	ACL            *pipe.ACL
+}
+
+func (opts *UDPOptions) init() {
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = 2 * time.Minute
+	}
+	if opts.ReadBufferSize <= 0 {
+		opts.ReadBufferSize = 65535
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1024
+	}
+}
+
+// UDPStats are the counters of a UDPListener since it was created.
+type UDPStats struct {
+	Sessions  int
+	Accepted  uint64
+	Expired   uint64
+	Rejected  uint64
+	Dropped   uint64
+	Truncated uint64
+	Denied    uint64
+}
+
 type UDPListener struct {
 	mux sync.Mutex
 
@@ -164,56 +251,171 @@ type UDPListener struct {
 	closed   int32
 	listened int32
 	conns    map[string]*UDPConn
+	opts     UDPOptions
+
+	accepted  uint64
+	expired   uint64
+	rejected  uint64
+	dropped   uint64
+	truncated uint64
+	denied    uint64
 }
 
 func (ln *UDPListener) deleteConn(uc *UDPConn) {
 	ln.mux.Lock()
 	defer ln.mux.Unlock()
-	delete(ln.conns, uc.raddr.String())
+	if ln.conns[uc.raddr.String()] == uc {
+		delete(ln.conns, uc.raddr.String())
+	}
 }
 
 func (ln *UDPListener) accept() {
+	buf := make([]byte, ln.opts.ReadBufferSize+1)
 	for {
-		buf := make([]byte, 2048)
 		n, raddr, err := ln.uc.ReadFromUDP(buf)
 		if err != nil {
 			return
 		}
-		pkt := buf[:n]
+		if !ln.opts.ACL.Allowed(raddr.IP) {
+			atomic.AddUint64(&ln.denied, 1)
+			continue
+		}
+		if n > ln.opts.ReadBufferSize {
+			atomic.AddUint64(&ln.truncated, 1)
+			continue
+		}
+		pkt := append([]byte(nil), buf[:n]...)
 		saddr := raddr.String()
-		func() {
-			ln.mux.Lock()
-			defer ln.mux.Unlock()
-			uc, ok := ln.conns[saddr]
-			if ok {
-				select {
-				case uc.chData <- pkt:
-				default:
-				}
-				return
+		now := time.Now().UnixNano()
+
+		ln.mux.Lock()
+		uc, ok := ln.conns[saddr]
+		if !ok {
+			if ln.opts.MaxSessions > 0 && len(ln.conns) >= ln.opts.MaxSessions {
+				ln.mux.Unlock()
+				atomic.AddUint64(&ln.rejected, 1)
+				continue
 			}
 			uc = &UDPConn{
 				laddr:    ln.Addr(),
 				raddr:    raddr,
-				cache:    buf[:n],
-				chData:   make(chan []byte, 1024),
+				cache:    pkt,
+				chData:   make(chan []byte, ln.opts.QueueSize),
 				chWrote:  make(chan struct{}),
 				chClsoed: make(chan struct{}),
 				parent:   ln.uc,
+				active:   now,
 			}
 			uc.fClose = func() error {
 				ln.deleteConn(uc)
 				return nil
 			}
 			ln.conns[saddr] = uc
-			ln.ch <- uc
-		}()
+			ln.mux.Unlock()
+			atomic.AddUint64(&ln.accepted, 1)
+			select {
+			case ln.ch <- uc:
+			case <-ln.ctx.Done():
+				return
+			}
+			continue
+		}
+		ln.mux.Unlock()
+
+		atomic.StoreInt64(&uc.active, now)
+		ln.enqueue(uc, pkt)
 	}
 }
 
+func (ln *UDPListener) enqueue(uc *UDPConn, pkt []byte) {
+	select {
+	case uc.chData <- pkt:
+		return
+	case <-uc.chClsoed:
+		return
+	default:
+	}
+
+	switch ln.opts.QueuePolicy {
+	case UDPQueueDropOldest:
+		select {
+		case <-uc.chData:
+			atomic.AddUint64(&ln.dropped, 1)
+		default:
+		}
+		select {
+		case uc.chData <- pkt:
+		default:
+			atomic.AddUint64(&ln.dropped, 1)
+		}
+	case UDPQueueBlock:
+		select {
+		case uc.chData <- pkt:
+		case <-uc.chClsoed:
+		case <-ln.ctx.Done():
+		}
+	default:
+		atomic.AddUint64(&ln.dropped, 1)
+	}
+}
+
+func (ln *UDPListener) expire() {
+	interval := ln.opts.IdleTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ln.ctx.Done():
+			return
+		}
+		deadline := time.Now().Add(-ln.opts.IdleTimeout).UnixNano()
+		var idle []*UDPConn
+		ln.mux.Lock()
+		for _, uc := range ln.conns {
+			if atomic.LoadInt64(&uc.active) < deadline {
+				idle = append(idle, uc)
+			}
+		}
+		ln.mux.Unlock()
+		for _, uc := range idle {
+			atomic.AddUint64(&ln.expired, 1)
+			uc.Close()
+		}
+	}
+}
+
+// Stats returns a snapshot of the listener's counters.
+func (ln *UDPListener) Stats() UDPStats {
+	ln.mux.Lock()
+	sessions := len(ln.conns)
+	ln.mux.Unlock()
+	return UDPStats{
+		Sessions:  sessions,
+		Accepted:  atomic.LoadUint64(&ln.accepted),
+		Expired:   atomic.LoadUint64(&ln.expired),
+		Rejected:  atomic.LoadUint64(&ln.rejected),
+		Dropped:   atomic.LoadUint64(&ln.dropped),
+		Truncated: atomic.LoadUint64(&ln.truncated),
+		Denied:    atomic.LoadUint64(&ln.denied),
+	}
+}
+
+// Dropped counts datagrams that never reached a session: rejected over
+// MaxSessions, truncated, denied by the ACL or dropped by the queue policy.
+func (ln *UDPListener) Dropped() uint64 {
+	return atomic.LoadUint64(&ln.rejected) + atomic.LoadUint64(&ln.dropped) + atomic.LoadUint64(&ln.truncated) + atomic.LoadUint64(&ln.denied)
+}
+
 func (ln *UDPListener) Accept() (net.Conn, error) {
 	if atomic.CompareAndSwapInt32(&ln.listened, 0, 1) {
 		go ln.accept()
+		if ln.opts.IdleTimeout > 0 {
+			go ln.expire()
+		}
 	}
 	select {
 	case c := <-ln.ch:
@@ -227,7 +429,6 @@ func (ln *UDPListener) Close() error {
 	if atomic.CompareAndSwapInt32(&ln.closed, 0, 1) {
 		if ln.uc != nil {
 			err := ln.uc.Close()
-			ln.uc = nil
 			ln.cancel()
 			return err
 		}
@@ -243,12 +444,20 @@ func (ln *UDPListener) Addr() net.Addr {
 }
 
 func ListenUDP(addr string) func() (net.Listener, error) {
+	return ListenUDPWithOptions(addr, nil)
+}
+
+func ListenUDPWithOptions(addr string, opts *UDPOptions) func() (net.Listener, error) {
 	return func() (net.Listener, error) {
 		var err error
 		var ln = &UDPListener{
 			ch:    make(chan *UDPConn, 1024),
 			conns: map[string]*UDPConn{},
 		}
+		if opts != nil {
+			ln.opts = *opts
+		}
+		ln.opts.init()
 		ln.ctx, ln.cancel = context.WithCancel(context.Background())
 		udpAddr, err := net.ResolveUDPAddr("udp", addr)
 		if err != nil {
@@ -1,39 +1,217 @@
 package protocol
 
 import (
-	"fmt"
+	"crypto/tls"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	gorilla "github.com/gorilla/websocket"
 	"github.com/lesismal/arpc/extension/protocol/websocket"
 )
 
+// WebsocketOptions configures ListenWebsocketWithOptions and
+// DialWebsocketWithOptions.
+//
+// Path defaults to "/ws". TLSConfig switches to wss. Header is sent with the
+// client's handshake, a "Host" entry overrides the Host header. On the
+// server, CheckOrigin and CheckRequest reject handshakes, and Mux mounts the
+// handler on an existing http.ServeMux served by the caller instead of
+// listening on addr, so the pipe can share a port with a website. The handler
+// is mounted once and answers 503 while the pipe is stopped.
+type WebsocketOptions struct {
+	Path             string
+	TLSConfig        *tls.Config
+	Header           http.Header
+	CheckOrigin      func(r *http.Request) bool
+	CheckRequest     func(r *http.Request) bool
+	Mux              *http.ServeMux
+	HandshakeTimeout time.Duration
+}
+
+func (opts *WebsocketOptions) path() string {
+	if opts == nil || opts.Path == "" {
+		return "/ws"
+	}
+	return opts.Path
+}
+
+type websocketListener struct {
+	net.Listener
+	server *http.Server
+
+	mux      sync.Mutex
+	serveErr error
+}
+
+// Accept returns the error that stopped the http server, if that is why the
+// listener was closed.
+func (ln *websocketListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		ln.mux.Lock()
+		if ln.serveErr != nil {
+			err = ln.serveErr
+		}
+		ln.mux.Unlock()
+	}
+	return c, err
+}
+
+func (ln *websocketListener) Close() error {
+	err := ln.Listener.Close()
+	if ln.server != nil {
+		ln.server.Close()
+	}
+	return err
+}
+
+func (ln *websocketListener) serve(tcpLn net.Listener) {
+	err := ln.server.Serve(tcpLn)
+	if err != http.ErrServerClosed {
+		ln.mux.Lock()
+		ln.serveErr = err
+		ln.mux.Unlock()
+		ln.Close()
+	}
+}
+
+// websocketMount is the handler mounted once on a caller's ServeMux, it
+// forwards to the listener of the latest Listen call and answers 503 while
+// none is open, so a pipe can be stopped and started again on the same mux.
+type websocketMount struct {
+	mux  sync.Mutex
+	once sync.Once
+	ln   *websocket.Listener
+	opts *WebsocketOptions
+}
+
+func (m *websocketMount) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mux.Lock()
+	ln := m.ln
+	m.mux.Unlock()
+	if ln == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	websocketHandler(ln, m.opts)(w, r)
+}
+
+func (m *websocketMount) listen(ln *websocket.Listener) net.Listener {
+	m.once.Do(func() {
+		m.opts.Mux.Handle(m.opts.path(), m)
+	})
+	m.mux.Lock()
+	m.ln = ln
+	m.mux.Unlock()
+	return &mountedListener{Listener: ln, mount: m}
+}
+
+type mountedListener struct {
+	*websocket.Listener
+	mount *websocketMount
+}
+
+func (ln *mountedListener) Close() error {
+	ln.mount.mux.Lock()
+	if ln.mount.ln == ln.Listener {
+		ln.mount.ln = nil
+	}
+	ln.mount.mux.Unlock()
+	return ln.Listener.Close()
+}
+
+func websocketHandler(ln *websocket.Listener, opts *WebsocketOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opts.CheckRequest != nil && !opts.CheckRequest(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ln.Handler(w, r)
+	}
+}
+
 func ListenWebsocket(addr string) func() (net.Listener, error) {
+	return ListenWebsocketWithOptions(addr, nil)
+}
+
+func ListenWebsocketWithOptions(addr string, opts *WebsocketOptions) func() (net.Listener, error) {
+	if opts == nil {
+		opts = &WebsocketOptions{}
+	}
+	mount := &websocketMount{opts: opts}
 	return func() (net.Listener, error) {
-		ln, err := websocket.Listen(addr, nil)
+		upgrader := &gorilla.Upgrader{
+			HandshakeTimeout: opts.HandshakeTimeout,
+			CheckOrigin:      opts.CheckOrigin,
+		}
+		if upgrader.CheckOrigin == nil {
+			upgrader.CheckOrigin = func(r *http.Request) bool {
+				return true
+			}
+		}
+		ln, err := websocket.Listen(addr, upgrader)
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.Mux != nil {
+			return mount.listen(ln.(*websocket.Listener)), nil
+		}
+
+		tcpLn, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if opts.TLSConfig != nil {
+			tcpLn = tls.NewListener(tcpLn, opts.TLSConfig)
+		}
 		mux := &http.ServeMux{}
-		mux.HandleFunc("/ws", ln.(*websocket.Listener).Handler)
-		server := http.Server{
-			Addr:    addr,
-			Handler: mux,
+		mux.HandleFunc(opts.path(), websocketHandler(ln.(*websocket.Listener), opts))
+		wsLn := &websocketListener{
+			Listener: ln,
+			server: &http.Server{
+				Addr:    addr,
+				Handler: mux,
+			},
 		}
-		go server.ListenAndServe()
-		return ln, err
+		go wsLn.serve(tcpLn)
+		return wsLn, nil
 	}
 }
 
 func DialWebsocket(dstAddr string) func(net.Conn) (net.Conn, error) {
-	dialer := &gorilla.Dialer{HandshakeTimeout: time.Second * 10}
-	return func(src net.Conn) (net.Conn, error) {
-		return websocket.Dial(fmt.Sprintf("ws://%v/ws", dstAddr), dialer)
-	}
+	return DialWebsocketWithTimeout(dstAddr, time.Second*10)
 }
 
 func DialWebsocketWithTimeout(dstAddr string, timeout time.Duration) func(net.Conn) (net.Conn, error) {
-	dialer := &gorilla.Dialer{HandshakeTimeout: timeout}
+	return DialWebsocketWithOptions(dstAddr, &WebsocketOptions{HandshakeTimeout: timeout})
+}
+
+func DialWebsocketWithOptions(dstAddr string, opts *WebsocketOptions) func(net.Conn) (net.Conn, error) {
+	if opts == nil {
+		opts = &WebsocketOptions{}
+	}
+	timeout := opts.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	dialer := &gorilla.Dialer{
+		HandshakeTimeout: timeout,
+		TLSClientConfig:  opts.TLSConfig,
+	}
+	u := url.URL{Scheme: "ws", Host: dstAddr, Path: opts.path()}
+	if opts.TLSConfig != nil {
+		u.Scheme = "wss"
+	}
+	wsURL := u.String()
 	return func(src net.Conn) (net.Conn, error) {
-		return websocket.Dial(fmt.Sprintf("ws://%v/ws", dstAddr), dialer)
+		c, _, err := dialer.Dial(wsURL, opts.Header)
+		if err != nil {
+			return nil, err
+		}
+		return &websocket.Conn{Conn: c}, nil
 	}
 }
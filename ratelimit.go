@@ -0,0 +1,203 @@
+package pipe
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limit is a rate in bytes per second for each direction of a session, zero
+// means unlimited.
+type Limit struct {
+	SrcToDst int64
+	DstToSrc int64
+}
+
+// bucket is a token bucket that may go into debt: a write larger than the
+// burst is let through and the following ones wait until it is paid back.
+type bucket struct {
+	mux    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	b := &bucket{}
+	b.setRate(rate)
+	return b
+}
+
+func (b *bucket) setRate(rate int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.rate = float64(rate)
+	b.tokens = b.rate
+	b.last = time.Now()
+}
+
+// reserve takes n tokens and returns how long to wait before using them.
+func (b *bucket) reserve(n int) time.Duration {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+	// burst is one second worth of traffic
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type ipBuckets struct {
+	buckets [2]*bucket
+	refs    int
+}
+
+// RateLimiter shapes the bytes copied by a Pipe with token buckets per
+// session, per source IP and for the whole Pipe, each per direction. The
+// limits can be changed at any time and apply to live sessions.
+type RateLimiter struct {
+	mux      sync.Mutex
+	session  Limit
+	perIP    Limit
+	global   [2]*bucket
+	ips      map[string]*ipBuckets
+	sessions map[*sessionLimiter]struct{}
+}
+
+func NewRateLimiter(session, perIP, global Limit) *RateLimiter {
+	return &RateLimiter{
+		session:  session,
+		perIP:    perIP,
+		global:   [2]*bucket{newBucket(global.SrcToDst), newBucket(global.DstToSrc)},
+		ips:      map[string]*ipBuckets{},
+		sessions: map[*sessionLimiter]struct{}{},
+	}
+}
+
+// SetSessionLimit changes the limit of every session, including the live
+// ones, except those set with Pipe.SetSessionLimit.
+func (rl *RateLimiter) SetSessionLimit(l Limit) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	rl.session = l
+	for sl := range rl.sessions {
+		if !sl.overridden {
+			sl.setLimit(l)
+		}
+	}
+}
+
+// SetIPLimit changes the limit shared by all sessions from one source IP.
+func (rl *RateLimiter) SetIPLimit(l Limit) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	rl.perIP = l
+	for _, ib := range rl.ips {
+		ib.buckets[dirSrcToDst].setRate(l.SrcToDst)
+		ib.buckets[dirDstToSrc].setRate(l.DstToSrc)
+	}
+}
+
+// SetGlobalLimit changes the limit shared by all sessions of the Pipe.
+func (rl *RateLimiter) SetGlobalLimit(l Limit) {
+	rl.global[dirSrcToDst].setRate(l.SrcToDst)
+	rl.global[dirDstToSrc].setRate(l.DstToSrc)
+}
+
+func (rl *RateLimiter) newSession(src net.Conn) *sessionLimiter {
+	ip := hostOf(src.RemoteAddr())
+
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	ib, ok := rl.ips[ip]
+	if !ok {
+		ib = &ipBuckets{buckets: [2]*bucket{newBucket(rl.perIP.SrcToDst), newBucket(rl.perIP.DstToSrc)}}
+		rl.ips[ip] = ib
+	}
+	ib.refs++
+	sl := &sessionLimiter{
+		rl:      rl,
+		ip:      ip,
+		session: [2]*bucket{newBucket(rl.session.SrcToDst), newBucket(rl.session.DstToSrc)},
+		perIP:   ib.buckets,
+	}
+	rl.sessions[sl] = struct{}{}
+	return sl
+}
+
+func (rl *RateLimiter) release(sl *sessionLimiter) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	delete(rl.sessions, sl)
+	if ib, ok := rl.ips[sl.ip]; ok {
+		ib.refs--
+		if ib.refs <= 0 {
+			delete(rl.ips, sl.ip)
+		}
+	}
+}
+
+type sessionLimiter struct {
+	rl         *RateLimiter
+	ip         string
+	session    [2]*bucket
+	perIP      [2]*bucket
+	overridden bool
+}
+
+func (sl *sessionLimiter) setLimit(l Limit) {
+	sl.session[dirSrcToDst].setRate(l.SrcToDst)
+	sl.session[dirDstToSrc].setRate(l.DstToSrc)
+}
+
+// wait blocks until n bytes may be copied in dir, or done is closed.
+func (sl *sessionLimiter) wait(dir int, n int, done <-chan struct{}) error {
+	d := sl.session[dir].reserve(n)
+	if d2 := sl.perIP[dir].reserve(n); d2 > d {
+		d = d2
+	}
+	if d2 := sl.rl.global[dir].reserve(n); d2 > d {
+		d = d2
+	}
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return net.ErrClosed
+	}
+}
+
+// SetSessionLimit overrides the RateLimiter's session limit for the live
+// session with id, it reports whether the session was found.
+func (p *Pipe) SetSessionLimit(id uint64, l Limit) bool {
+	if p.RateLimiter == nil {
+		return false
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, s := range p.conns {
+		if s.ID == id && s.limiter != nil {
+			p.RateLimiter.mux.Lock()
+			s.limiter.overridden = true
+			s.limiter.setLimit(l)
+			p.RateLimiter.mux.Unlock()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package pipe
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSessionClosed = errors.New("session closed by admin")
+
+// liveSession is the registry entry of one accepted connection, from Accept
+// until both directions have stopped copying.
+type liveSession struct {
+	Session
+
+	ip      string
+	wg      *sync.WaitGroup
+	stats   *pipeMetrics
+	limiter *sessionLimiter
+	bytes   [2]int64
+	active  int64
+	closed  int32
+	once    sync.Once
+	done    chan struct{}
+}
+
+func newLiveSession(id uint64, src net.Conn, ip string, stats *pipeMetrics) *liveSession {
+	now := time.Now()
+	return &liveSession{
+		Session: Session{ID: id, Src: src, Start: now},
+		ip:      ip,
+		stats:   stats,
+		active:  now.UnixNano(),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *liveSession) addCopied(dir int, n int) {
+	atomic.AddInt64(&s.bytes[dir], int64(n))
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+	s.stats.addCopied(dir, n)
+}
+
+// close marks the session closed and returns the conns to close, it must be
+// called with the pipe's mux held since Dst is set under it. The conns are
+// closed by closeAll after the mux is released, some conns write to the
+// network in Close and must not stall the whole pipe.
+func (s *liveSession) close() []net.Conn {
+	s.once.Do(func() { close(s.done) })
+	if s.Dst != nil {
+		return []net.Conn{s.Src, s.Dst}
+	}
+	return []net.Conn{s.Src}
+}
+
+func (s *liveSession) kill() []net.Conn {
+	atomic.StoreInt32(&s.closed, 1)
+	return s.close()
+}
+
+func closeAll(conns []net.Conn) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (s *liveSession) killed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+// SessionInfo is a snapshot of a live session as returned by Sessions.
+type SessionInfo struct {
+	ID        uint64        `json:"id"`
+	SrcRemote string        `json:"src_remote"`
+	SrcLocal  string        `json:"src_local"`
+	DstLocal  string        `json:"dst_local,omitempty"`
+	DstRemote string        `json:"dst_remote,omitempty"`
+	Start     time.Time     `json:"start"`
+	SrcToDst  int64         `json:"src_to_dst"`
+	DstToSrc  int64         `json:"dst_to_src"`
+	Idle      time.Duration `json:"idle_ns"`
+}
+
+// Sessions lists the live sessions ordered by ID, sessions still dialing have
+// no dst addresses yet.
+func (p *Pipe) Sessions() []SessionInfo {
+	now := time.Now()
+	p.mux.Lock()
+	infos := make([]SessionInfo, 0, len(p.conns))
+	for _, s := range p.conns {
+		info := SessionInfo{
+			ID:        s.ID,
+			SrcRemote: s.Src.RemoteAddr().String(),
+			SrcLocal:  s.Src.LocalAddr().String(),
+			Start:     s.Start,
+			SrcToDst:  atomic.LoadInt64(&s.bytes[dirSrcToDst]),
+			DstToSrc:  atomic.LoadInt64(&s.bytes[dirDstToSrc]),
+			Idle:      now.Sub(time.Unix(0, atomic.LoadInt64(&s.active))),
+		}
+		if s.Dst != nil {
+			info.DstLocal = s.Dst.LocalAddr().String()
+			info.DstRemote = s.Dst.RemoteAddr().String()
+		}
+		infos = append(infos, info)
+	}
+	p.mux.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseSession closes both connections of the session with id, it reports
+// whether the session was found.
+func (p *Pipe) CloseSession(id uint64) bool {
+	p.mux.Lock()
+	for _, s := range p.conns {
+		if s.ID == id {
+			conns := s.kill()
+			p.mux.Unlock()
+			closeAll(conns)
+			return true
+		}
+	}
+	p.mux.Unlock()
+	return false
+}
+
+// CloseSessionsFrom closes every session whose src remote address is addr,
+// either an exact "host:port" or a bare host matching any port, and returns
+// how many were closed.
+func (p *Pipe) CloseSessionsFrom(addr string) int {
+	var conns []net.Conn
+	n := 0
+	p.mux.Lock()
+	for _, s := range p.conns {
+		if s.Src.RemoteAddr().String() == addr || s.ip == addr {
+			conns = append(conns, s.kill()...)
+			n++
+		}
+	}
+	p.mux.Unlock()
+	closeAll(conns)
+	return n
+}
+
+// AdminHandler serves the session API as JSON:
+//
+//	GET             lists the live sessions
+//	DELETE ?id=N    closes one session
+//	DELETE ?src=IP  closes every session from that source address
+//
+// It has no authentication, mount it on a private address.
+func (p *Pipe) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(p.Sessions())
+		case http.MethodDelete:
+			q := r.URL.Query()
+			closed := 0
+			switch {
+			case q.Has("id"):
+				id, err := strconv.ParseUint(q.Get("id"), 10, 64)
+				if err != nil {
+					writeJSONError(w, http.StatusBadRequest, "invalid id")
+					return
+				}
+				if !p.CloseSession(id) {
+					writeJSONError(w, http.StatusNotFound, "session not found")
+					return
+				}
+				closed = 1
+			case q.Has("src"):
+				closed = p.CloseSessionsFrom(q.Get("src"))
+			default:
+				writeJSONError(w, http.StatusBadRequest, "id or src required")
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]int{"closed": closed})
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
+
+// writeJSONError writes an error body without http.Error, which would reset
+// the Content-Type to text/plain.
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// hostOf returns the host part of addr, or the whole address if it has no
+// port.
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}